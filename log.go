@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+type EventKind uint8
+
+const (
+	EventStarted EventKind = iota
+	EventCommitted
+	EventAborted
+	// A transaction is about to be aborted because of the conflict in Err.
+	EventConflict
+	// A version of Key was found visible or not to a transaction.
+	EventVisibility
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventStarted:
+		return "started"
+	case EventCommitted:
+		return "committed"
+	case EventAborted:
+		return "aborted"
+	case EventConflict:
+		return "conflict"
+	case EventVisibility:
+		return "visibility"
+	}
+	return "unknown"
+}
+
+// Something that happened to a transaction. Only the fields relevant to the
+// kind of event are set.
+type Event struct {
+	Kind      EventKind
+	TxId      uint64
+	Isolation IsolationLevel
+	Key       string
+	// The start id of the version whose visibility was decided.
+	VersionId uint64
+	Visible   bool
+	Err       error
+}
+
+func (e Event) String() string {
+	switch e.Kind {
+	case EventStarted:
+		return fmt.Sprintf("%s tx=%d isolation=%s", e.Kind, e.TxId, e.Isolation)
+	case EventConflict:
+		return fmt.Sprintf("%s tx=%d err=%q", e.Kind, e.TxId, e.Err)
+	case EventVisibility:
+		return fmt.Sprintf("%s tx=%d key=%s version=%d visible=%t", e.Kind, e.TxId, e.Key, e.VersionId, e.Visible)
+	}
+	return fmt.Sprintf("%s tx=%d", e.Kind, e.TxId)
+}
+
+// Receives the events of a database. Called while the database lock is held,
+// so it must not use the database.
+type Logger interface {
+	Log(event Event)
+}
+
+// Writes each event on its own line, the logger installed by --debug.
+type textLogger struct {
+	w io.Writer
+}
+
+func (l textLogger) Log(event Event) {
+	fmt.Fprintln(l.w, "DEBUG", event)
+}
+
+func (d *Database) log(event Event) {
+	if d.Logger != nil {
+		d.Logger.Log(event)
+	}
+}
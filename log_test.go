@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+type capturingLogger struct {
+	events []Event
+}
+
+func (l *capturingLogger) Log(event Event) {
+	l.events = append(l.events, event)
+}
+
+func TestLogger(t *testing.T) {
+	logger := &capturingLogger{}
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+	db.Logger = logger
+
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	c2.mustExecCommand("set", []string{"x", "c2"})
+	c1.mustExecCommand("commit", nil)
+
+	_, err := c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrWriteWriteConflict), "c2 commit")
+
+	kinds := []EventKind{}
+	for _, event := range logger.events {
+		if event.Kind != EventVisibility {
+			kinds = append(kinds, event.Kind)
+		}
+	}
+	expected := []EventKind{EventStarted, EventStarted, EventCommitted, EventConflict, EventAborted}
+	assert(slices.Equal(kinds, expected), "event kinds")
+
+	conflict := logger.events[len(logger.events)-2]
+	assertEq(conflict.Kind, EventConflict, "conflict event")
+	assertEq(conflict.TxId, uint64(2), "conflict tx")
+	assertEq(conflict.Err, ErrWriteWriteConflict, "conflict error")
+	assertEq(conflict.String(), `conflict tx=2 err="write-write conflict"`, "conflict string")
+}
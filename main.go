@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"cmp"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math"
 	"os"
 	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/tidwall/btree"
 )
@@ -32,10 +41,16 @@ func debug(a ...any) {
 	fmt.Println(a...)
 }
 
+// Transaction ids double as start timestamps: they are handed out in
+// increasing order, so a version whose txStartId is greater than a
+// transaction's id was written after the transaction began. Whether an older
+// writer committed before the transaction began is decided by commit ids.
 type Value struct {
 	txStartId uint64
 	txEndId   uint64
 	value     string
+	// The version is treated as deleted from this time on, if set.
+	expiresAt time.Time
 }
 
 type TransactionState uint8
@@ -44,8 +59,25 @@ const (
 	TransactionStateInProgress TransactionState = iota
 	TransactionStateAborted
 	TransactionStateCommitted
+	// Passed the commit conflict checks and waits for an external coordinator
+	// to commit or abort it. Its writes stay invisible to other transactions
+	// until then, and commits that would conflict with it fail instead.
+	TransactionStatePrepared
 )
 
+func (s TransactionState) String() string {
+	switch s {
+	case TransactionStateInProgress:
+		return "inprogress"
+	case TransactionStateAborted:
+		return "aborted"
+	case TransactionStatePrepared:
+		return "prepared"
+	default:
+		return "committed"
+	}
+}
+
 type IsolationLevel uint8
 
 // Ordered isolation level enum. Stricter isolation levels have a bigger value.
@@ -57,22 +89,86 @@ const (
 	IsolationLevelSerializable
 )
 
-const (
-	errNoSuchKey          = "no such key"
-	errWriteWriteConflict = "write-write conflict"
-	errReadWriteConflict  = "read-write conflict"
+// The names of the isolation levels, indexed by level.
+var isolationLevelNames = []string{
+	"read_uncommitted",
+	"read_committed",
+	"repeatable_read",
+	"snapshot",
+	"serializable",
+}
+
+func (l IsolationLevel) String() string {
+	return isolationLevelNames[l]
+}
+
+func parseIsolationLevel(name string) (IsolationLevel, bool) {
+	i := slices.Index(isolationLevelNames, name)
+	return IsolationLevel(i), i >= 0
+}
+
+var (
+	ErrNoSuchKey          = errors.New("no such key")
+	ErrWriteWriteConflict = errors.New("write-write conflict")
+	ErrReadWriteConflict  = errors.New("read-write conflict")
+	ErrNoSuchSavepoint    = errors.New("no such savepoint")
+	ErrReadOnly           = errors.New("read-only transaction")
+	ErrUnknownIsolation   = errors.New("unknown isolation level")
+	ErrCasMismatch        = errors.New("cas mismatch")
+	ErrNotInteger         = errors.New("value is not an integer")
+	ErrActiveTransactions = errors.New("active transactions")
+	ErrNoSuchTransaction  = errors.New("no such transaction")
+	ErrWrongArgs          = errors.New("wrong number of arguments")
+	ErrTimedOut           = errors.New("transaction timed out")
+
+	ErrTransactionInProgress = errors.New("transaction already in progress")
+	ErrNoTransaction         = errors.New("no transaction")
+	ErrIdsExhausted          = errors.New("transaction ids exhausted")
+	ErrStoreNotEmpty         = errors.New("store is not empty")
+	ErrConditionFailed       = errors.New("condition failed")
+	ErrDeadlock              = errors.New("deadlock detected")
+	ErrNotPositive           = errors.New("value is not a positive integer")
+	ErrAbortedExternally     = errors.New("transaction aborted externally")
+	ErrTransactionFinished   = errors.New("transaction already finished")
+	ErrIsolationTooWeak      = errors.New("isolation level below minimum")
+	ErrWriteLimit            = errors.New("transaction write limit exceeded")
+	ErrRetry                 = errors.New("retry transaction")
+	ErrStaleVersion          = errors.New("stale version")
+	ErrIsolationTooStrong    = errors.New("isolation level too strong")
+	ErrInvalidTime           = errors.New("invalid time")
+	ErrHistoryUnavailable    = errors.New("history no longer available")
+	ErrDatabaseClosed        = errors.New("database closed")
+	ErrNoSuchProfile         = errors.New("no such profile")
+	ErrTransactionPrepared   = errors.New("transaction is prepared")
+	ErrInsufficientFunds     = errors.New("insufficient funds")
+	ErrInvalidSnapshot       = errors.New("invalid snapshot")
+	ErrOverflow              = errors.New("integer overflow")
 )
 
 type Transaction struct {
 	id        uint64
 	isolation IsolationLevel
 	state     TransactionState
+	// Read-only transactions can't write and don't track their reads, so they
+	// never conflict with other transactions.
+	readonly bool
+	// Whether the transaction sees its own writes before it commits, true
+	// unless begun with no_read_your_writes.
+	readYourWrites bool
+
+	// The order in which the transaction committed, zero until it does, and
+	// when it did.
+	commitId   uint64
+	commitTime time.Time
 
 	// Used by repeatable read isolation or stricter
 
 	// The set of in-progress transactions at the time this transaction is
 	// created identified by their keys.
 	inprogress btree.Set[uint64]
+	// The commit id of the latest transaction committed when this transaction
+	// was created. Writes of transactions committed after it are invisible.
+	snapshot uint64
 
 	// Used by snapshot isolation or stricter
 
@@ -82,56 +178,542 @@ type Transaction struct {
 	// The set of values read by this transaction during its lifetime identified
 	// by their keys.
 	readset btree.Set[string]
+	// The predicates of the key ranges read by this transaction, so that a
+	// write of a key in the range that didn't exist when it was read is a
+	// conflict as well.
+	predicates []func(key string) bool
+
+	// The changes made by this transaction to the version chains in the order
+	// they were made, used to roll them back on abort or to a savepoint.
+	undo       []undoRecord
+	savepoints []savepoint
+
+	// The version of each key a repeatable read (or stricter) transaction
+	// last resolved, which only its own writes can change. Entries are
+	// dropped when the transaction writes or rolls back the key.
+	reads map[string]cachedRead
+
+	startTime time.Time
+	// Why the transaction was aborted by the database rather than by its
+	// connection, reported to the connection on its next command.
+	abortReason error
+}
+
+// Reports whether the transaction has yet to commit or abort.
+func (t *Transaction) active() bool {
+	return t.state == TransactionStateInProgress || t.state == TransactionStatePrepared
+}
+
+// Records the key in the readset so conflicting writes can be detected.
+func (t *Transaction) recordRead(key string) {
+	if !t.readonly {
+		t.readset.Insert(key)
+	}
+}
+
+// Records the predicate of a key range read by the transaction.
+func (t *Transaction) recordPredicate(match func(key string) bool) {
+	if !t.readonly {
+		t.predicates = append(t.predicates, match)
+	}
+}
+
+type undoRecord struct {
+	key       string
+	txStartId uint64
+	// Whether the change marked the version deleted rather than writing the
+	// transaction's own version.
+	mark bool
+	// The transaction's own version as it was before the change, unless the
+	// change created it.
+	prev    Value
+	existed bool
+}
+
+type cachedRead struct {
+	value Value
+	ok    bool
+}
+
+type savepoint struct {
+	name string
+	// The number of undo records at the time the savepoint was created.
+	undo     int
+	writeset btree.Set[string]
+	readset  btree.Set[string]
+	// The number of predicates at the time the savepoint was created.
+	predicates int
 }
 
+// The versions of a key identified by the id of the transaction that created
+// them. A transaction that writes a key more than once replaces its own
+// version, which is invisible to every transaction once overwritten anyway.
+type versions = btree.Map[uint64, Value]
+
 type Database struct {
-	defaultIsolation  IsolationLevel
-	store             map[string][]Value
-	transactions      btree.Map[uint64, Transaction]
+	// Guards all the fields below. Taken by execCommand and the exported
+	// methods, the unexported methods assume it is already held.
+	mu sync.Mutex
+
+	defaultIsolation IsolationLevel
+	// The transaction profiles selected with "begin profile <name>".
+	profiles map[string]profile
+	// Detect write-write conflicts of snapshot isolation transactions when
+	// writing a key that a concurrent transaction already wrote, aborting the
+	// later writer right away instead of when it commits.
+	FirstUpdaterWins bool
+
+	store        map[string]*versions
+	transactions btree.Map[uint64, *Transaction]
+	// Never wraps around, as that would break the ordering of ids that
+	// visibility relies on. The maximum id is never handed out.
 	nextTransactionId uint64
+	// Handed out to transactions as they commit, which need not be the order
+	// in which they started.
+	nextCommitId uint64
+	// The commit id of the last transaction that wrote each key, and the
+	// committed transactions by commit id, so that commit conflicts are only
+	// checked against the transactions that committed after a transaction
+	// started. Entries older than every in-progress transaction are dropped by
+	// vacuum.
+	lastWrite map[string]uint64
+	commits   btree.Map[uint64, *Transaction]
+	// The last commit vacuum dropped from commits and when it committed, so
+	// that the commit at a later time can still be told.
+	prunedCommitId   uint64
+	prunedCommitTime time.Time
+	// The prepared transactions, which commits must not conflict with.
+	prepared []*Transaction
+
+	// In-progress transactions older than this are aborted by ReapExpired,
+	// unless it is zero.
+	TxTimeout time.Duration
+
+	// When non-zero, writing a key whose chain already has this many versions
+	// first evicts its oldest versions that no in-progress transaction can see,
+	// if there are any.
+	MaxVersionsPerKey int
+	// The commit id below which snapshots may have seen versions of each key
+	// that eviction dropped, so that getas and getastime fail with
+	// ErrHistoryUnavailable rather than miss them. Entries no snapshot that
+	// can still be read from is below are dropped by vacuum.
+	evictedBelow map[string]uint64
+
+	// When non-zero, writing a new key while the store holds this many first
+	// evicts the least recently read or written key, with all its versions,
+	// unless a transaction in progress wrote or can see any of them.
+	MaxKeys int
+	// When each key was last read or written, by a counter bumped on every
+	// access, for picking the key to evict.
+	accessed    map[string]uint64
+	accessClock uint64
+
+	// When non-zero, the most distinct keys a single transaction may write.
+	MaxWritesPerTx int
+
+	// Makes snapshot isolation transactions conflict only over the keys that a
+	// transaction committed since they began wrote with a different value
+	// than theirs, rather than over every key both wrote.
+	ValueAwareConflicts bool
+
+	// Makes deleting a key that isn't visible succeed without writing
+	// anything, instead of failing with ErrNoSuchKey.
+	DeleteIdempotent bool
+
+	// Transactions can't begin at a weaker isolation level than this.
+	MinIsolation IsolationLevel
+
+	// Consulted when a transaction fails to commit because of a conflict,
+	// kind being "write-write" or "read-write". The transaction is aborted
+	// either way, when nil too.
+	ConflictPolicy func(t *Transaction, kind string) Decision
+
+	// Receives the events of the transactions, unless nil.
+	Logger Logger
+
+	// The clock used to expire values and transactions, replaceable in tests.
+	now func() time.Time
+
+	stats       Stats
+	commitHooks []func(txId uint64, writeset []string)
+	expireHooks []func(key string)
+	watchers    map[string][]chan struct{}
+
+	// The committed versions already reported to expireHooks, so that each
+	// is reported once. Entries are dropped with their versions by vacuum.
+	expiredVersions map[versionRef]struct{}
+
+	// The keys locked with "lock <key> wait" and the transaction holding each,
+	// and the key each blocked transaction waits for, which together form the
+	// wait-for graph. Waiters are woken up whenever a transaction ends.
+	locks        map[string]uint64
+	waitsFor     map[uint64]string
+	lockReleased *sync.Cond
+
+	// Closed to stop the background vacuum, and closed by it once stopped.
+	// Nil when it isn't running.
+	stopVacuum    chan struct{}
+	vacuumStopped chan struct{}
+
+	// Set by Shutdown, after which every command fails with
+	// ErrDatabaseClosed.
+	closed bool
+
+	// When set, the commands of connections running concurrently wait for
+	// their turn in the order the gate prescribes. Only meant for tests.
+	stepGate *stepGate
+
+	// The other namespaces of this database by name, created on first use.
+	// Guarded by namespacesMu rather than mu, so that a connection can switch
+	// namespaces while holding the lock of the one it is in.
+	namespacesMu sync.Mutex
+	namespaces   map[string]*Database
+}
+
+// Sets the isolation level of transactions begun without an explicit one.
+// Transactions already in progress keep their level.
+func (d *Database) SetDefaultIsolation(level IsolationLevel) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.defaultIsolation = level
+}
+
+type profile struct {
+	isolation IsolationLevel
+	readonly  bool
+}
+
+// Identifies a version of a key by the transaction that wrote it.
+type versionRef struct {
+	key       string
+	txStartId uint64
+}
+
+// Registers fn to be called with the key when a committed version that wasn't
+// deleted is first seen expired, by a read or by vacuum. Expiry is lazy, so
+// this may be long after the version expired, and never if it isn't looked
+// at. Like commit callbacks, they run while the database lock is held, so they
+// must be fast and must not use the database.
+func (d *Database) OnExpire(fn func(key string)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expireHooks = append(d.expireHooks, fn)
+}
+
+// Calls the expiry callbacks if the version is the live version of the key
+// and has just been seen expired for the first time.
+func (d *Database) observeExpiry(key string, value Value) {
+	if len(d.expireHooks) == 0 || value.expiresAt.IsZero() || value.txEndId != 0 ||
+		d.now().Before(value.expiresAt) || d.transaction(value.txStartId).state != TransactionStateCommitted {
+		return
+	}
+
+	version := versionRef{key: key, txStartId: value.txStartId}
+	if _, ok := d.expiredVersions[version]; ok {
+		return
+	}
+
+	d.expiredVersions[version] = struct{}{}
+	for _, fn := range d.expireHooks {
+		fn(key)
+	}
+}
+
+// Registers a named transaction profile, so that "begin profile <name>" begins
+// a transaction at the given isolation level, read-only if readonly is set.
+// Registering a name again replaces its profile.
+func (d *Database) RegisterProfile(name string, isolation IsolationLevel, readonly bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.profiles[name] = profile{isolation: isolation, readonly: readonly}
+}
+
+// Registers fn to be called after every successful commit with the id of the
+// committed transaction and the sorted keys it modified. Callbacks run while
+// the database lock is held, so they must be fast and must not use the
+// database.
+func (d *Database) OnCommit(fn func(txId uint64, writeset []string)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.commitHooks = append(d.commitHooks, fn)
+}
+
+// Returns a channel that receives a signal whenever a transaction that wrote
+// the key commits. Signals are coalesced: while one is pending, further ones
+// are dropped rather than blocking the committer.
+func (d *Database) Watch(key string) <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	d.watchers[key] = append(d.watchers[key], ch)
+	return ch
+}
+
+// Stops signaling a channel returned by Watch for the key.
+func (d *Database) Unwatch(key string, ch <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.watchers[key] = slices.DeleteFunc(d.watchers[key], func(watcher chan struct{}) bool {
+		return watcher == ch
+	})
+	if len(d.watchers[key]) == 0 {
+		delete(d.watchers, key)
+	}
+}
+
+// What to tell the client whose transaction failed to commit because of a
+// conflict.
+type Decision uint8
+
+const (
+	// Return the conflict error.
+	DecisionAbort Decision = iota
+	// Return the conflict error wrapped with ErrRetry, to signal that running
+	// the transaction again is likely to succeed.
+	DecisionRetry
+)
+
+type Stats struct {
+	Started   uint64
+	Committed uint64
+	// Aborted by their connection, or by the database for reasons other than
+	// a conflict.
+	Aborted             uint64
+	WriteWriteConflicts uint64
+	ReadWriteConflicts  uint64
+	InProgress          uint64
+}
+
+// Returns a snapshot of the transaction counters.
+func (d *Database) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.stats
+}
+
+// The size of what the database retains, for deciding when to vacuum.
+type MemStats struct {
+	Keys     int
+	Versions int
+	// The total length of the values of all the versions.
+	ValueBytes int
+	// The finished transactions not yet dropped by vacuum.
+	CommittedTransactions int
+	AbortedTransactions   int
+}
+
+func (s MemStats) String() string {
+	return fmt.Sprintf("keys=%d versions=%d value_bytes=%d committed=%d aborted=%d",
+		s.Keys, s.Versions, s.ValueBytes, s.CommittedTransactions, s.AbortedTransactions)
+}
+
+// Counts the versions and retained transactions, walking the whole store.
+func (d *Database) MemStats() MemStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.memStats()
+}
+
+func (d *Database) memStats() MemStats {
+	stats := MemStats{Keys: len(d.store)}
+	for _, chain := range d.store {
+		stats.Versions += chain.Len()
+		chain.Scan(func(_ uint64, value Value) bool {
+			stats.ValueBytes += len(value.value)
+			return true
+		})
+	}
+
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		switch iter.Value().state {
+		case TransactionStateCommitted:
+			stats.CommittedTransactions += 1
+		case TransactionStateAborted:
+			stats.AbortedTransactions += 1
+		}
+	}
+
+	return stats
 }
 
 func newDatabase() *Database {
-	return &Database{
+	d := &Database{
 		defaultIsolation:  IsolationLevelReadCommitted,
-		store:             map[string][]Value{},
+		store:             map[string]*versions{},
 		nextTransactionId: 1,
+		nextCommitId:      1,
+		now:               time.Now,
+		lastWrite:         map[string]uint64{},
+		evictedBelow:      map[string]uint64{},
+		accessed:          map[string]uint64{},
+		profiles:          map[string]profile{},
+		expiredVersions:   map[versionRef]struct{}{},
+		watchers:          map[string][]chan struct{}{},
+		locks:             map[string]uint64{},
+		waitsFor:          map[uint64]string{},
+	}
+	d.lockReleased = sync.NewCond(&d.mu)
+	return d
+}
+
+// Returns the namespace with the given name, an isolated keyspace created on
+// first use with a copy of the database's settings, profiles and callbacks as
+// they are then. Each namespace is a database of its own, with its own lock,
+// transactions and ids, so a transaction never spans namespaces and conflicts
+// are only detected within one. The empty name and "default" are the database
+// itself.
+func (d *Database) Namespace(name string) *Database {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.namespace(name)
+}
+
+func (d *Database) namespace(name string) *Database {
+	if name == "" || name == "default" {
+		return d
+	}
+
+	d.namespacesMu.Lock()
+	defer d.namespacesMu.Unlock()
+
+	if d.namespaces == nil {
+		d.namespaces = map[string]*Database{}
+	}
+
+	ns, ok := d.namespaces[name]
+	if !ok {
+		ns = newDatabase()
+		ns.defaultIsolation = d.defaultIsolation
+		ns.profiles = maps.Clone(d.profiles)
+		ns.FirstUpdaterWins = d.FirstUpdaterWins
+		ns.TxTimeout = d.TxTimeout
+		ns.MaxVersionsPerKey = d.MaxVersionsPerKey
+		ns.MaxKeys = d.MaxKeys
+		ns.MaxWritesPerTx = d.MaxWritesPerTx
+		ns.ValueAwareConflicts = d.ValueAwareConflicts
+		ns.DeleteIdempotent = d.DeleteIdempotent
+		ns.MinIsolation = d.MinIsolation
+		ns.ConflictPolicy = d.ConflictPolicy
+		ns.Logger = d.Logger
+		ns.now = d.now
+		ns.commitHooks = slices.Clone(d.commitHooks)
+		ns.expireHooks = slices.Clone(d.expireHooks)
+		ns.closed = d.closed
+		d.namespaces[name] = ns
 	}
+	return ns
 }
 
 func (d *Database) inprogress() btree.Set[uint64] {
 	ids := btree.Set[uint64]{}
 	iter := d.transactions.Iter()
 	for ok := iter.First(); ok; ok = iter.Next() {
-		if iter.Value().state == TransactionStateInProgress {
+		if iter.Value().active() {
 			ids.Insert(iter.Key())
 		}
 	}
 	return ids
 }
 
-func (d *Database) newTransaction() *Transaction {
-	t := Transaction{
-		isolation:  d.defaultIsolation,
-		state:      TransactionStateInProgress,
-		id:         d.nextTransactionId,
-		inprogress: d.inprogress(),
+func (d *Database) newTransaction(isolation IsolationLevel, readonly bool) (*Transaction, error) {
+	if d.nextTransactionId == math.MaxUint64 {
+		return nil, ErrIdsExhausted
+	}
+
+	if isolation < d.MinIsolation {
+		return nil, ErrIsolationTooWeak
+	}
+
+	t := &Transaction{
+		isolation:      isolation,
+		readonly:       readonly,
+		readYourWrites: true,
+		state:          TransactionStateInProgress,
+		id:             d.nextTransactionId,
+		inprogress:     d.inprogress(),
+		snapshot:       d.nextCommitId - 1,
+		startTime:      d.now(),
 	}
 
 	d.nextTransactionId += 1
 	d.transactions.Set(t.id, t)
 
-	debug("starting transaction", t.id)
+	d.stats.Started += 1
+	d.stats.InProgress += 1
+
+	d.log(Event{Kind: EventStarted, TxId: t.id, Isolation: t.isolation})
+
+	return t, nil
+}
+
+// Restarts transaction ids from 1, forgetting all past transactions. Only
+// allowed on an empty database without transactions in progress, meant for
+// test harnesses.
+func (d *Database) ResetTransactionIds() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if inprogress := d.inprogress(); inprogress.Len() > 0 {
+		return fmt.Errorf("cannot reset transaction ids with %w", ErrActiveTransactions)
+	}
+
+	if len(d.store) > 0 {
+		return fmt.Errorf("cannot reset transaction ids: %w", ErrStoreNotEmpty)
+	}
+
+	d.forgetTransactions()
+	return nil
+}
+
+// Removes every key and forgets all past transactions, restarting ids from 1.
+// Only allowed without transactions in progress, whose snapshots it would
+// break.
+func (d *Database) FlushAll() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.flushAll()
+}
+
+func (d *Database) flushAll() error {
+	if inprogress := d.inprogress(); inprogress.Len() > 0 {
+		return fmt.Errorf("cannot flush with %w", ErrActiveTransactions)
+	}
+
+	clear(d.store)
+	clear(d.accessed)
+	clear(d.expiredVersions)
+	d.forgetTransactions()
+	return nil
+}
 
-	return &t
+// Forgets all the finished transactions, restarting ids from 1.
+func (d *Database) forgetTransactions() {
+	d.transactions = btree.Map[uint64, *Transaction]{}
+	d.nextTransactionId = 1
+	d.nextCommitId = 1
+	d.lastWrite = map[string]uint64{}
+	d.commits = btree.Map[uint64, *Transaction]{}
+	d.prunedCommitId = 0
+	d.prunedCommitTime = time.Time{}
+	d.evictedBelow = map[string]uint64{}
 }
 
 func setsShareItem(s1, s2 btree.Set[string]) bool {
 	s1Iter := s1.Iter()
-	s2Iter := s2.Iter()
 
 	for ok := s1Iter.First(); ok; ok = s1Iter.Next() {
-		if s2Iter.Seek(s1Iter.Key()) {
+		if s2.Contains(s1Iter.Key()) {
 			return true
 		}
 	}
@@ -139,228 +721,2669 @@ func setsShareItem(s1, s2 btree.Set[string]) bool {
 	return false
 }
 
-func isWriteWriteConflict(t1, t2 *Transaction) bool {
-	return setsShareItem(t1.writeset, t2.writeset)
-}
+// Returns the keys matching any of the predicates.
+func predicatesMatch(predicates []func(key string) bool, keys btree.Set[string]) []string {
+	matched := []string{}
+	iter := keys.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		for _, match := range predicates {
+			if match(iter.Key()) {
+				matched = append(matched, iter.Key())
+				break
+			}
+		}
+	}
 
-func isReadWriteConflict(t1, t2 *Transaction) bool {
-	return setsShareItem(t1.readset, t2.writeset) || setsShareItem(t2.writeset, t1.readset)
+	return matched
 }
 
 func (d *Database) completeTransaction(t *Transaction, state TransactionState) error {
-	debug("completing transaction ", t.id)
-
-	d.assertValidTransaction(t)
-	assert(state != TransactionStateInProgress, "not InProgress state")
+	assert(t.id > 0 && t.active(), "active transaction")
+	assert(state == TransactionStateCommitted || state == TransactionStateAborted, "final state")
 
 	if state == TransactionStateCommitted {
-		if t.isolation == IsolationLevelSnapshot && d.hasConflict(t, isWriteWriteConflict) {
-			d.completeTransaction(t, TransactionStateAborted)
-			return errors.New(errWriteWriteConflict)
+		// A prepared transaction was already checked, and no commit since
+		// could conflict with it.
+		if t.state != TransactionStatePrepared {
+			if err := d.commitConflict(t); err != nil {
+				return d.abortConflicting(t, err)
+			}
 		}
 
-		if t.isolation == IsolationLevelSerializable && d.hasConflict(t, isReadWriteConflict) {
-			d.completeTransaction(t, TransactionStateAborted)
-			return errors.New(errReadWriteConflict)
+		// What is left of the keys committed since were written with the
+		// same values, which the transaction need not write again.
+		if d.ValueAwareConflicts && t.isolation == IsolationLevelSnapshot {
+			for _, key := range d.writtenSince(t.writeset, t.snapshot) {
+				d.dropWrite(t, key)
+			}
 		}
+
+		d.stats.Committed += 1
+	} else {
+		d.stats.Aborted += 1
 	}
 
-	t.state = state
-	d.transactions.Set(t.id, *t)
+	d.endTransaction(t, state)
 
-	return nil
-}
+	if state == TransactionStateCommitted && len(d.commitHooks) > 0 {
+		writeset := t.writeset.Keys()
+		for _, fn := range d.commitHooks {
+			fn(t.id, writeset)
+		}
+	}
 
-func (d *Database) assertValidTransaction(t *Transaction) {
-	assert(t.id > 0, "valid transaction id")
-	assert(t.state == TransactionStateInProgress, "transaction in progress")
-}
+	if state == TransactionStateCommitted && len(d.watchers) > 0 {
+		iter := t.writeset.Iter()
+		for ok := iter.First(); ok; ok = iter.Next() {
+			for _, ch := range d.watchers[iter.Key()] {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
 
-func (d *Database) transaction(id uint64) Transaction {
-	tx, ok := d.transactions.Get(id)
-	assert(ok, "valid transaction")
-	return tx
+	return nil
 }
 
-func (d *Database) isVisible(t *Transaction, value Value) bool {
-	// Refer to the 1999 ANSI SQL standard (page 84) for the meaning of each isolation level.
-
-	if t.isolation == IsolationLevelReadUncommitted {
-		// All values are visible even if not committed, we merely verify that
-		// the value has not been deleted.
-		return value.txEndId == 0
+// Returns the commit id of the last transaction that had committed at the
+// given time. Only the commits still in the conflict index can be told apart,
+// so times before the last one vacuum dropped fail with ErrHistoryUnavailable.
+func (d *Database) commitIdAt(at time.Time) (uint64, error) {
+	if d.prunedCommitId > 0 && at.Before(d.prunedCommitTime) {
+		return 0, ErrHistoryUnavailable
 	}
 
-	if t.isolation == IsolationLevelReadCommitted {
-		// Started by another transaction but it's not committed.
-		if value.txStartId != t.id && d.transaction(value.txStartId).state != TransactionStateCommitted {
-			return false
-		}
-
-		// Deleted by this transaction so should not be visible anymore.
-		if value.txEndId == t.id {
-			return false
-		}
-
-		// Deleted by another committed transaction.
-		if value.txEndId > 0 && d.transaction(value.txEndId).state == TransactionStateCommitted {
+	commitId := d.prunedCommitId
+	d.commits.Scan(func(id uint64, t *Transaction) bool {
+		if t.commitTime.After(at) {
 			return false
 		}
-
-		// Otherwise visible.
+		commitId = id
 		return true
-	}
+	})
 
-	// Repeatable read and stricter
-	assert(t.isolation >= IsolationLevelRepeatableRead, "repeatable read or stricter")
+	return commitId, nil
+}
 
-	// Started after this transaction.
-	if value.txStartId > t.id {
-		return false
+// Aborts the transaction that failed to commit or prepare because of the
+// conflict, returning the error to report.
+func (d *Database) abortConflicting(t *Transaction, err *ConflictError) error {
+	kind := "write-write"
+	if errors.Is(err, ErrWriteWriteConflict) {
+		d.stats.WriteWriteConflicts += 1
+	} else {
+		kind = "read-write"
+		d.stats.ReadWriteConflicts += 1
 	}
+	d.log(Event{Kind: EventConflict, TxId: t.id, Err: err.Err})
+	d.endTransaction(t, TransactionStateAborted)
 
-	// Started by transactions in progress.
-	if t.inprogress.Contains(value.txStartId) {
-		return false
+	if d.ConflictPolicy != nil && d.ConflictPolicy(t, kind) == DecisionRetry {
+		return fmt.Errorf("%w: %w", ErrRetry, err)
 	}
+	return err
+}
 
-	// Started by other transactions that are not committed yet.
-	if value.txStartId != t.id && d.transaction(value.txStartId).state != TransactionStateCommitted {
-		return false
-	}
+// Runs the commit conflict checks and, if they pass, moves the transaction to
+// the prepared state, from which committing can't fail. Otherwise the
+// transaction is aborted like a failed commit.
+func (d *Database) prepareTransaction(t *Transaction) error {
+	d.assertValidTransaction(t)
 
-	// Value was deleted in other committed transaction that started before this one
-	if value.txEndId > 0 && value.txEndId < t.id &&
-		!t.inprogress.Contains(value.txEndId) &&
-		d.transaction(value.txEndId).state == TransactionStateCommitted {
-		return false
+	if err := d.commitConflict(t); err != nil {
+		return d.abortConflicting(t, err)
 	}
 
-	return true
+	t.state = TransactionStatePrepared
+	d.prepared = append(d.prepared, t)
+	return nil
 }
 
-func (d *Database) hasConflict(t1 *Transaction, conflictFn func(*Transaction, *Transaction) bool) bool {
-	iter := d.transactions.Iter()
-	inprogressIter := t1.inprogress.Iter()
-	for ok := inprogressIter.First(); ok; ok = inprogressIter.Next() {
-		if !iter.Seek(inprogressIter.Key()) {
+// Returns the conflict with a prepared transaction that committing t would
+// cause: writing a key that the prepared transaction wrote under snapshot
+// isolation, or read under serializable isolation.
+func (d *Database) preparedConflict(t *Transaction) *ConflictError {
+	for _, p := range d.prepared {
+		if p == t {
 			continue
 		}
 
-		t2 := iter.Value()
-		if t2.state == TransactionStateCommitted && conflictFn(t1, &t2) {
-			return true
-		}
-	}
+		conflict := &ConflictError{}
+		iter := t.writeset.Iter()
+		for ok := iter.First(); ok; ok = iter.Next() {
+			key := iter.Key()
+			if p.isolation == IsolationLevelSnapshot && p.writeset.Contains(key) {
+				conflict.Err = ErrWriteWriteConflict
+				conflict.Keys = append(conflict.Keys, key)
+			}
 
-	for id := t1.id; id < d.nextTransactionId; id++ {
-		if !iter.Seek(id) {
-			continue
+			if p.isolation == IsolationLevelSerializable &&
+				(p.readset.Contains(key) || slices.ContainsFunc(p.predicates, func(match func(string) bool) bool { return match(key) })) {
+				conflict.Err = ErrReadWriteConflict
+				conflict.Keys = append(conflict.Keys, key)
+			}
 		}
 
-		t2 := iter.Value()
-		if t2.state == TransactionStateCommitted && conflictFn(t1, &t2) {
-			return true
+		if len(conflict.Keys) > 0 {
+			return conflict
 		}
 	}
 
-	return false
-}
-
-type Connection struct {
-	tx *Transaction
-	db *Database
+	return nil
 }
 
-func (c *Connection) execCommand(command string, args []string) (string, error) {
-	debug(command, args)
-
-	if command == "begin" {
-		assertEq(c.tx, nil, "no running transaction")
-		c.tx = c.db.newTransaction()
-		return fmt.Sprintf("%d", c.tx.id), nil
+// Returns the error committing the transaction would fail with because of a
+// conflict with a transaction that committed after it started, or with a
+// prepared one, if any.
+//
+// Serializable isolation aborts a committing transaction that read a key, or a
+// range, written by any such transaction. That rules out every
+// rw-antidependency between concurrent transactions, cycles or not, so it
+// prevents write skew as well as lost updates and is truly serializable, at the
+// cost of aborting some transactions that a serial order would have allowed.
+func (d *Database) commitConflict(t *Transaction) *ConflictError {
+	if err := d.committedConflict(t); err != nil {
+		return err
 	}
 
-	if command == "abort" {
-		c.db.assertValidTransaction(c.tx)
-		err := c.db.completeTransaction(c.tx, TransactionStateAborted)
-		c.tx = nil
-		return "", err
-	}
+	return d.preparedConflict(t)
+}
 
-	if command == "commit" {
-		c.db.assertValidTransaction(c.tx)
-		err := c.db.completeTransaction(c.tx, TransactionStateCommitted)
-		c.tx = nil
-		return "", err
+// Returns the conflict with a transaction that committed after t started, if
+// any, which will fail t's commit whatever happens next.
+func (d *Database) committedConflict(t *Transaction) *ConflictError {
+	if t.isolation == IsolationLevelSnapshot {
+		keys := d.writtenSince(t.writeset, t.snapshot)
+		if d.ValueAwareConflicts {
+			keys = slices.DeleteFunc(keys, func(key string) bool { return d.sameAsCommitted(t, key) })
+		}
+		if len(keys) > 0 {
+			return &ConflictError{Err: ErrWriteWriteConflict, Keys: keys}
+		}
 	}
 
-	if command == "get" {
-		c.db.assertValidTransaction(c.tx)
-		key := args[0]
-		c.tx.readset.Insert(key)
-		for i := len(c.db.store[key]) - 1; i >= 0; i -= 1 {
-			value := c.db.store[key][i]
-			debug(value, c.tx, c.db.isVisible(c.tx, value))
-			if c.db.isVisible(c.tx, value) {
-				return value.value, nil
-			}
+	if t.isolation == IsolationLevelSerializable {
+		keys := d.writtenSince(t.readset, t.snapshot)
+		keys = append(keys, d.predicateWrittenSince(t.predicates, t.snapshot)...)
+		if len(keys) > 0 {
+			slices.Sort(keys)
+			return &ConflictError{Err: ErrReadWriteConflict, Keys: slices.Compact(keys)}
 		}
-
-		return "", errors.New(errNoSuchKey)
 	}
 
-	if command == "set" || command == "delete" {
-		c.db.assertValidTransaction(c.tx)
-		key := args[0]
+	return nil
+}
 
-		found := false
-		for i := len(c.db.store[key]) - 1; i >= 0; i -= 1 {
-			value := &c.db.store[key][i]
-			debug(value, c.tx, c.db.isVisible(c.tx, *value))
-			if c.db.isVisible(c.tx, *value) {
-				value.txEndId = c.tx.id
-				found = true
-			}
-		}
+// Reports whether the transaction wrote the key with the same value as the
+// latest committed version of it.
+func (d *Database) sameAsCommitted(t *Transaction, key string) bool {
+	chain := d.chain(key)
+	own, ok := chain.Get(t.id)
+	if !ok {
+		return false
+	}
 
-		if command == "delete" && !found {
-			return "", errors.New(errNoSuchKey)
+	same := false
+	chain.Reverse(func(id uint64, value Value) bool {
+		if id == t.id || d.transaction(id).state != TransactionStateCommitted {
+			return true
 		}
+		deleted := value.txEndId > 0 && d.transaction(value.txEndId).state == TransactionStateCommitted
+		same = !deleted && value.value == own.value
+		return false
+	})
 
-		c.tx.writeset.Insert(key)
+	return same
+}
 
-		if command == "set" {
-			value := args[1]
-			c.db.store[key] = append(c.db.store[key], Value{
-				txStartId: c.tx.id,
-				txEndId:   0,
-				value:     value,
-			})
+// Drops the transaction's own version of the key and its own delete marks on
+// the others, leaving its other changes, for a write that a committed
+// transaction already made. The marks committed transactions made since are
+// kept.
+func (d *Database) dropWrite(t *Transaction, key string) {
+	chain := d.chain(key)
+	chain.Delete(t.id)
 
-			return value, nil
+	marked := []Value{}
+	chain.Scan(func(id uint64, value Value) bool {
+		if value.txEndId == t.id {
+			marked = append(marked, value)
 		}
+		return true
+	})
+	for _, value := range marked {
+		value.txEndId = 0
+		chain.Set(value.txStartId, value)
+	}
 
-		// Delete ok.
-		return "", nil
+	if chain.Len() == 0 {
+		delete(d.store, key)
 	}
 
-	return "", errors.New("unimplemented")
+	t.undo = slices.DeleteFunc(t.undo, func(record undoRecord) bool { return record.key == key })
+	t.writeset.Delete(key)
+	delete(t.reads, key)
 }
 
-func (c *Connection) mustExecCommand(cmd string, args []string) string {
-	res, err := c.execCommand(cmd, args)
-	assertEq(err, nil, "unexpected error")
-	return res
+// The error of a commit that failed because transactions that committed since
+// it began wrote some of the keys, which it either wrote (ErrWriteWriteConflict)
+// or read (ErrReadWriteConflict), so that only those need to be read again
+// before retrying.
+type ConflictError struct {
+	Err  error
+	Keys []string
 }
 
-func (d *Database) newConnection() *Connection {
-	return &Connection{
-		tx: nil,
-		db: d,
+// The message is that of the conflict alone, which clients match on, the keys
+// being only available through Keys.
+func (e *ConflictError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the keys written by a transaction that committed after the given
+// commit id, in order.
+func (d *Database) writtenSince(keys btree.Set[string], commitId uint64) []string {
+	written := []string{}
+	iter := keys.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if d.lastWrite[iter.Key()] > commitId {
+			written = append(written, iter.Key())
+		}
 	}
+
+	return written
 }
 
-func main() {
-	panic("unimplemented")
+// Returns the keys matching any of the predicates written by a transaction
+// that committed after the given commit id.
+func (d *Database) predicateWrittenSince(predicates []func(key string) bool, commitId uint64) []string {
+	if len(predicates) == 0 {
+		return nil
+	}
+
+	written := []string{}
+	d.commits.Ascend(commitId+1, func(_ uint64, t *Transaction) bool {
+		written = append(written, predicatesMatch(predicates, t.writeset)...)
+		return true
+	})
+
+	return written
+}
+
+func (d *Database) endTransaction(t *Transaction, state TransactionState) {
+	if t.state == TransactionStatePrepared {
+		d.prepared = slices.DeleteFunc(d.prepared, func(p *Transaction) bool { return p == t })
+	}
+
+	if state == TransactionStateAborted {
+		d.rollback(t, 0)
+	}
+
+	if state == TransactionStateCommitted {
+		t.commitId = d.nextCommitId
+		t.commitTime = d.now()
+		d.nextCommitId += 1
+
+		iter := t.writeset.Iter()
+		for ok := iter.First(); ok; ok = iter.Next() {
+			d.lastWrite[iter.Key()] = t.commitId
+		}
+		d.commits.Set(t.commitId, t)
+	}
+
+	t.state = state
+	d.stats.InProgress -= 1
+
+	if state == TransactionStateCommitted {
+		d.log(Event{Kind: EventCommitted, TxId: t.id})
+	} else {
+		d.log(Event{Kind: EventAborted, TxId: t.id})
+	}
+
+	for key, holder := range d.locks {
+		if holder == t.id {
+			delete(d.locks, key)
+		}
+	}
+	delete(d.waitsFor, t.id)
+	d.lockReleased.Broadcast()
+}
+
+// Locks the key for the transaction, waiting until the transaction holding it
+// ends. When waiting would close a cycle in the wait-for graph, the youngest
+// transaction in the cycle is aborted with ErrDeadlock, which may be t itself.
+func (d *Database) lockWait(t *Transaction, key string) error {
+	for {
+		if t.state != TransactionStateInProgress {
+			return t.abortReason
+		}
+
+		holder, ok := d.locks[key]
+		if !ok || holder == t.id {
+			d.locks[key] = t.id
+			delete(d.waitsFor, t.id)
+			return nil
+		}
+
+		d.waitsFor[t.id] = key
+		if cycle := d.waitCycle(t); cycle != nil {
+			victim := slices.MaxFunc(cycle, func(a, b *Transaction) int {
+				return cmp.Compare(a.id, b.id)
+			})
+
+			debug("deadlock, aborting transaction", victim.id)
+			d.completeTransaction(victim, TransactionStateAborted)
+			victim.abortReason = ErrDeadlock
+			continue
+		}
+
+		d.lockReleased.Wait()
+	}
+}
+
+// Returns the transactions on the cycle of the wait-for graph through t, or
+// nil if there is none. A transaction waits for a single key, so following
+// the waits from t either ends or comes back to t.
+func (d *Database) waitCycle(t *Transaction) []*Transaction {
+	cycle := []*Transaction{t}
+	for current := t; ; {
+		key, ok := d.waitsFor[current.id]
+		if !ok {
+			return nil
+		}
+
+		holder, ok := d.locks[key]
+		if !ok {
+			return nil
+		}
+
+		current = d.transaction(holder)
+		if current == t {
+			return cycle
+		}
+		if slices.Contains(cycle, current) {
+			return nil
+		}
+		cycle = append(cycle, current)
+	}
+}
+
+// Reports whether the transaction with the given id committed before t took
+// its snapshot.
+func (d *Database) committedBefore(t *Transaction, id uint64) bool {
+	writer := d.transaction(id)
+	return writer.state == TransactionStateCommitted && writer.commitId <= t.snapshot
+}
+
+// Undoes the changes the transaction made to the version chains after its
+// first n undo records, newest first.
+func (d *Database) rollback(t *Transaction, n int) {
+	for i := len(t.undo) - 1; i >= n; i -= 1 {
+		d.undo(t, t.undo[i])
+		delete(t.reads, t.undo[i].key)
+	}
+
+	t.undo = t.undo[:n]
+}
+
+// Reverts a change of the transaction. Only its own marks are cleared, as
+// concurrent transactions may have marked the version deleted since, and their
+// marks must survive it.
+func (d *Database) undo(t *Transaction, record undoRecord) {
+	chain := d.chain(record.key)
+	value, ok := chain.Get(record.txStartId)
+	switch {
+	case record.mark:
+		if ok && value.txEndId == t.id {
+			value.txEndId = 0
+			chain.Set(record.txStartId, value)
+		}
+	case record.existed:
+		prev := record.prev
+		if ok && value.txEndId != t.id {
+			prev.txEndId = value.txEndId
+		}
+		chain.Set(record.txStartId, prev)
+	default:
+		chain.Delete(record.txStartId)
+	}
+
+	if chain.Len() == 0 {
+		delete(d.store, record.key)
+	}
+}
+
+// Aborts the in-progress transactions that started more than TxTimeout ago and
+// returns how many were aborted. Their connections get ErrTimedOut on their
+// next command.
+func (d *Database) ReapExpired() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.TxTimeout == 0 {
+		return 0
+	}
+
+	expired := []*Transaction{}
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		t := iter.Value()
+		if t.state == TransactionStateInProgress && d.now().Sub(t.startTime) > d.TxTimeout {
+			expired = append(expired, t)
+		}
+	}
+
+	for _, t := range expired {
+		debug("reaping transaction", t.id)
+		d.completeTransaction(t, TransactionStateAborted)
+		t.abortReason = ErrTimedOut
+	}
+
+	return len(expired)
+}
+
+// Describes an in-progress transaction.
+type TransactionInfo struct {
+	Id        uint64
+	Isolation IsolationLevel
+	// The sizes of its readset and writeset.
+	Reads  int
+	Writes int
+}
+
+// Describes the transactions in progress, sorted by id.
+func (d *Database) InProgressTransactions() []TransactionInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.inProgressTransactions()
+}
+
+func (d *Database) inProgressTransactions() []TransactionInfo {
+	infos := []TransactionInfo{}
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		t := iter.Value()
+		if t.active() {
+			infos = append(infos, TransactionInfo{
+				Id:        t.id,
+				Isolation: t.isolation,
+				Reads:     t.readset.Len(),
+				Writes:    t.writeset.Len(),
+			})
+		}
+	}
+	return infos
+}
+
+// Aborts the in-progress transaction with the given id on behalf of another
+// connection. Its connection gets ErrAbortedExternally on its next command.
+func (d *Database) AbortTransaction(id uint64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.abortTransaction(id)
+}
+
+func (d *Database) abortTransaction(id uint64) error {
+	t, ok := d.transactions.Get(id)
+	if !ok {
+		return ErrNoSuchTransaction
+	}
+
+	// Only the coordinator of a prepared transaction may abort it.
+	if t.state == TransactionStatePrepared {
+		return ErrTransactionPrepared
+	}
+
+	if t.state != TransactionStateInProgress {
+		return ErrTransactionFinished
+	}
+
+	d.completeTransaction(t, TransactionStateAborted)
+	t.abortReason = ErrAbortedExternally
+	return nil
+}
+
+func (d *Database) assertValidTransaction(t *Transaction) {
+	assert(t.id > 0, "valid transaction id")
+	assert(t.state == TransactionStateInProgress, "transaction in progress")
+}
+
+// Stands in for the transactions dropped by vacuum, all of which committed
+// before every in-progress transaction started, or aborted and left no
+// versions or delete marks behind, as aborting undoes them.
+var forgottenTransaction = &Transaction{state: TransactionStateCommitted}
+
+func (d *Database) transaction(id uint64) *Transaction {
+	tx, ok := d.transactions.Get(id)
+	if !ok {
+		assert(id > 0 && id < d.nextTransactionId, "valid transaction")
+		return forgottenTransaction
+	}
+	return tx
+}
+
+func (d *Database) isVisible(t *Transaction, value Value) bool {
+	// Refer to the 1999 ANSI SQL standard (page 84) for the meaning of each isolation level.
+
+	// Expired values are invisible at every isolation level.
+	if !value.expiresAt.IsZero() && !d.now().Before(value.expiresAt) {
+		return false
+	}
+
+	// The transaction reads as if its own writes hadn't happened yet.
+	if !t.readYourWrites {
+		if value.txStartId == t.id {
+			return false
+		}
+
+		if value.txEndId == t.id {
+			value.txEndId = 0
+		}
+	}
+
+	if t.isolation == IsolationLevelReadUncommitted {
+		// All values are visible even if not committed, we merely verify that
+		// the value has not been deleted.
+		return value.txEndId == 0
+	}
+
+	if t.isolation == IsolationLevelReadCommitted {
+		// Started by another transaction but it's not committed.
+		if value.txStartId != t.id && d.transaction(value.txStartId).state != TransactionStateCommitted {
+			return false
+		}
+
+		// Deleted by this transaction so should not be visible anymore.
+		if value.txEndId == t.id {
+			return false
+		}
+
+		// Deleted by another committed transaction.
+		if value.txEndId > 0 && d.transaction(value.txEndId).state == TransactionStateCommitted {
+			return false
+		}
+
+		// Otherwise visible.
+		return true
+	}
+
+	// Repeatable read and stricter
+	assert(t.isolation >= IsolationLevelRepeatableRead, "repeatable read or stricter")
+
+	// Started after this transaction.
+	if value.txStartId > t.id {
+		return false
+	}
+
+	// Started by another transaction that had not committed when this one
+	// started, even if it has committed since.
+	if value.txStartId != t.id && !d.committedBefore(t, value.txStartId) {
+		return false
+	}
+
+	// Deleted by this transaction so should not be visible anymore.
+	if value.txEndId == t.id {
+		return false
+	}
+
+	// Deleted by another transaction that committed before this one started.
+	if value.txEndId > 0 && d.committedBefore(t, value.txEndId) {
+		return false
+	}
+
+	return true
+}
+
+// Returns the id of the oldest transaction in progress, or the id the next
+// transaction will get if there is none. Vacuum may keep versions older than
+// this, for the transactions that an in-progress one must still tell apart.
+func (d *Database) OldestActiveTransaction() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.oldestActiveTransaction()
+}
+
+func (d *Database) oldestActiveTransaction() uint64 {
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if iter.Value().active() {
+			return iter.Key()
+		}
+	}
+	return d.nextTransactionId
+}
+
+// Returns the oldest transaction id that an in-progress transaction may still
+// need to decide visibility: either its own id or the id of a transaction that
+// was in progress when it started. Versions deleted by committed transactions
+// older than this are invisible to every current and future transaction.
+func (d *Database) horizon() uint64 {
+	horizon := d.nextTransactionId
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		t := iter.Value()
+		if !t.active() {
+			continue
+		}
+
+		horizon = min(horizon, t.id)
+		if id, ok := t.inprogress.Min(); ok {
+			horizon = min(horizon, id)
+		}
+	}
+
+	return horizon
+}
+
+// Removes the versions that can no longer be seen by any transaction and
+// returns how many were removed. Only versions deleted (or overwritten) by a
+// committed transaction are removed, so the latest committed value of a key is
+// always kept.
+func (d *Database) Vacuum() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.vacuum()
+}
+
+// Starts vacuuming in the background every interval, unless it is already
+// running.
+func (d *Database) StartVacuum(interval time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopVacuum != nil || d.closed {
+		return
+	}
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	d.stopVacuum, d.vacuumStopped = stop, stopped
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				d.Vacuum()
+			}
+		}
+	}()
+}
+
+// Stops the background vacuum, waiting for a pass in progress to finish.
+func (d *Database) StopVacuum() {
+	d.mu.Lock()
+	stop, stopped := d.stopVacuum, d.vacuumStopped
+	d.stopVacuum, d.vacuumStopped = nil, nil
+	d.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-stopped
+}
+
+// Closes the database and its namespaces: stops the background vacuum and
+// aborts every transaction in progress, rolling back its writes. Their
+// connections get ErrDatabaseClosed on their next command, as does every
+// command from then on. Commands already running finish first, as they hold
+// the lock.
+func (d *Database) Shutdown() {
+	d.StopVacuum()
+
+	d.mu.Lock()
+	d.close()
+	d.mu.Unlock()
+
+	// Not under the lock of the database, which connections in a namespace
+	// take while holding the namespace's to switch to another one.
+	d.namespacesMu.Lock()
+	namespaces := slices.Collect(maps.Values(d.namespaces))
+	d.namespacesMu.Unlock()
+
+	for _, ns := range namespaces {
+		ns.Shutdown()
+	}
+}
+
+func (d *Database) close() {
+	d.closed = true
+
+	inprogress := []*Transaction{}
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if t := iter.Value(); t.active() {
+			inprogress = append(inprogress, t)
+		}
+	}
+
+	for _, t := range inprogress {
+		d.completeTransaction(t, TransactionStateAborted)
+		t.abortReason = ErrDatabaseClosed
+	}
+}
+
+func (d *Database) vacuum() int {
+	horizon := d.horizon()
+	removed := 0
+
+	for key, chain := range d.store {
+		dead := []uint64{}
+		chain.Scan(func(id uint64, value Value) bool {
+			d.observeExpiry(key, value)
+			if value.txEndId > 0 && value.txEndId < horizon &&
+				d.transaction(value.txEndId).state == TransactionStateCommitted {
+				dead = append(dead, id)
+			}
+			return true
+		})
+
+		for _, id := range dead {
+			chain.Delete(id)
+			delete(d.expiredVersions, versionRef{key: key, txStartId: id})
+		}
+		removed += len(dead)
+
+		if chain.Len() == 0 {
+			delete(d.store, key)
+			delete(d.accessed, key)
+		}
+	}
+
+	d.pruneCommits()
+	debug("vacuum removed", removed, "versions below", horizon)
+
+	return removed
+}
+
+// Drops the finished transactions that no in-progress transaction, nor any
+// future one, can conflict with or needs to tell apart from one committed
+// before it started, along with their entries in the conflict index.
+func (d *Database) pruneCommits() {
+	oldest := d.nextCommitId - 1
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if t := iter.Value(); t.active() {
+			oldest = min(oldest, t.snapshot)
+		}
+	}
+
+	for key, commitId := range d.lastWrite {
+		if commitId <= oldest {
+			delete(d.lastWrite, key)
+		}
+	}
+
+	for {
+		commitId, t, ok := d.commits.Min()
+		if !ok || commitId > oldest {
+			break
+		}
+		d.commits.Delete(commitId)
+		d.prunedCommitId = commitId
+		d.prunedCommitTime = t.commitTime
+	}
+
+	forgotten := []uint64{}
+	iter = d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		t := iter.Value()
+		if t.state == TransactionStateAborted ||
+			(t.state == TransactionStateCommitted && t.commitId <= oldest) {
+			forgotten = append(forgotten, t.id)
+		}
+	}
+
+	for _, id := range forgotten {
+		d.transactions.Delete(id)
+	}
+
+	// getastime reads no snapshot before the last dropped commit, and getas
+	// none before that of the oldest transaction left.
+	floor := d.prunedCommitId
+	iter = d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		floor = min(floor, iter.Value().snapshot)
+	}
+	for key, below := range d.evictedBelow {
+		if below <= floor {
+			delete(d.evictedBelow, key)
+		}
+	}
+}
+
+type KeyStatus uint8
+
+// Distinguishes a key that is missing because its versions were deleted from
+// one that never had a version to begin with.
+const (
+	KeyStatusNeverExisted KeyStatus = iota
+	KeyStatusDeleted
+	KeyStatusPresent
+)
+
+func (s KeyStatus) String() string {
+	switch s {
+	case KeyStatusPresent:
+		return "present"
+	case KeyStatusDeleted:
+		return "deleted"
+	default:
+		return "never-existed"
+	}
+}
+
+func (d *Database) keyStatus(t *Transaction, key string) KeyStatus {
+	status := KeyStatusNeverExisted
+	d.descend(t, key, func(value Value) bool {
+		if d.isVisible(t, value) {
+			status = KeyStatusPresent
+			return false
+		}
+
+		// The version itself is not visible but its creation is, so it must
+		// have been deleted (or overwritten and the newer version deleted).
+		created := value
+		created.txEndId = 0
+		created.expiresAt = time.Time{}
+		if d.isVisible(t, created) {
+			status = KeyStatusDeleted
+		}
+		return true
+	})
+
+	return status
+}
+
+// Returns the keys in the store accepted by match in ascending order.
+func (d *Database) keys(match func(key string) bool) []string {
+	keys := []string{}
+	for key := range d.store {
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	slices.Sort(keys)
+	return keys
+}
+
+// Returns the version chain of the key, creating it if it doesn't exist.
+func (d *Database) chain(key string) *versions {
+	chain, ok := d.store[key]
+	if !ok {
+		chain = &versions{}
+		d.store[key] = chain
+	}
+	return chain
+}
+
+// Calls fn with the versions of the key that may be visible to the
+// transaction, newest first, until it returns false.
+//
+// Each version is passed by value, which copies only its string header and
+// never the bytes of the value, so walking a chain of large values allocates
+// nothing. The chain itself can't be changed through the copies; writes go
+// through the chain's Set.
+func (d *Database) descend(t *Transaction, key string, fn func(value Value) bool) {
+	chain, ok := d.store[key]
+	if !ok {
+		return
+	}
+
+	iter := func(_ uint64, value Value) bool {
+		return fn(value)
+	}
+
+	// Versions created after a repeatable read (or stricter) transaction
+	// started are never visible to it, so those can be skipped outright.
+	if t.isolation >= IsolationLevelRepeatableRead {
+		chain.Descend(t.id, iter)
+	} else {
+		chain.Reverse(iter)
+	}
+}
+
+// Returns the newest version of the key visible to the transaction, from the
+// transaction's cache when it already resolved it. Versions that expire aren't
+// cached, as they become invisible with time.
+func (d *Database) get(t *Transaction, key string) (Value, bool) {
+	if d.MaxKeys > 0 {
+		d.touch(key)
+	}
+
+	if cached, ok := t.reads[key]; ok {
+		return cached.value, cached.ok
+	}
+
+	found, ok := d.visibleVersion(t, key)
+	if t.isolation >= IsolationLevelRepeatableRead && found.expiresAt.IsZero() {
+		if t.reads == nil {
+			t.reads = map[string]cachedRead{}
+		}
+		t.reads[key] = cachedRead{value: found, ok: ok}
+	}
+
+	return found, ok
+}
+
+// Returns the newest version of the key visible to the transaction, walking
+// its chain.
+func (d *Database) visibleVersion(t *Transaction, key string) (Value, bool) {
+	found, ok := Value{}, false
+	d.descend(t, key, func(value Value) bool {
+		d.observeExpiry(key, value)
+		visible := d.isVisible(t, value)
+		if d.Logger != nil {
+			d.log(Event{Kind: EventVisibility, TxId: t.id, Key: key, VersionId: value.txStartId, Visible: visible})
+		}
+
+		if visible {
+			found, ok = value, true
+			return false
+		}
+		return true
+	})
+
+	return found, ok
+}
+
+// Marks the version of the key visible to the transaction as deleted by it
+// and returns whether there was one. At most one version of a key is visible
+// to a transaction since every write ends the version it could see.
+func (d *Database) markDeleted(t *Transaction, key string) bool {
+	delete(t.reads, key)
+
+	// Not cached, as concurrent transactions may have marked the version
+	// deleted since it was read.
+	value, ok := d.visibleVersion(t, key)
+	if !ok {
+		return false
+	}
+
+	t.undo = append(t.undo, undoRecord{key: key, txStartId: value.txStartId, mark: true})
+	value.txEndId = t.id
+	d.chain(key).Set(value.txStartId, value)
+
+	return true
+}
+
+// Installs a new version of the key written by the transaction.
+func (d *Database) set(t *Transaction, key string, value string) {
+	d.setExpiring(t, key, value, time.Time{})
+}
+
+// Installs a new version of the key written by the transaction that expires at
+// the given time, or never if it is zero.
+func (d *Database) setExpiring(t *Transaction, key string, value string, expiresAt time.Time) {
+	if d.MaxKeys > 0 {
+		if _, ok := d.store[key]; !ok && len(d.store) >= d.MaxKeys {
+			d.evictColdKey(t)
+		}
+		d.touch(key)
+	}
+
+	chain := d.chain(key)
+	if d.MaxVersionsPerKey > 0 && chain.Len() >= d.MaxVersionsPerKey {
+		d.evict(key, chain)
+	}
+
+	d.markDeleted(t, key)
+	t.writeset.Insert(key)
+
+	prev, existed := chain.Get(t.id)
+	t.undo = append(t.undo, undoRecord{key: key, txStartId: t.id, prev: prev, existed: existed})
+	chain.Set(t.id, Value{
+		txStartId: t.id,
+		txEndId:   0,
+		value:     value,
+		expiresAt: expiresAt,
+	})
+}
+
+func (d *Database) touch(key string) {
+	d.accessClock += 1
+	d.accessed[key] = d.accessClock
+}
+
+// Removes the least recently accessed key that no in-progress transaction
+// wrote or can see a version of, if there is one, to stay within MaxKeys. The
+// writer making room only keeps the keys it already read or wrote, or it could
+// never evict the committed keys it can see.
+func (d *Database) evictColdKey(writer *Transaction) {
+	inprogress := []*Transaction{}
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if t := iter.Value(); t.active() && t != writer {
+			inprogress = append(inprogress, t)
+		}
+	}
+
+	needed := func(chain *versions) bool {
+		found := false
+		chain.Scan(func(_ uint64, value Value) bool {
+			for _, t := range inprogress {
+				if value.txStartId == t.id || value.txEndId == t.id || d.isVisible(t, value) {
+					found = true
+					break
+				}
+			}
+			return !found
+		})
+		return found
+	}
+
+	coldest, found := "", false
+	for key, chain := range d.store {
+		if writer.readset.Contains(key) || writer.writeset.Contains(key) {
+			continue
+		}
+
+		if (!found || d.accessed[key] < d.accessed[coldest]) && !needed(chain) {
+			coldest, found = key, true
+		}
+	}
+
+	if found {
+		debug("evicting key", coldest)
+		delete(d.store, coldest)
+		delete(d.accessed, coldest)
+		d.evictedBelow[coldest] = d.nextCommitId
+	}
+}
+
+// Removes the oldest versions of the chain that were deleted by a committed
+// transaction and that no in-progress transaction can see, until the chain is
+// below MaxVersionsPerKey.
+func (d *Database) evict(key string, chain *versions) {
+	inprogress := []*Transaction{}
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if t := iter.Value(); t.active() {
+			inprogress = append(inprogress, t)
+		}
+	}
+
+	dead := []uint64{}
+	excess := chain.Len() - d.MaxVersionsPerKey + 1
+	chain.Scan(func(id uint64, value Value) bool {
+		if value.txEndId == 0 || d.transaction(value.txEndId).state != TransactionStateCommitted {
+			return true
+		}
+
+		visible := slices.ContainsFunc(inprogress, func(t *Transaction) bool {
+			return d.isVisible(t, value)
+		})
+		if !visible {
+			dead = append(dead, id)
+		}
+		return len(dead) < excess
+	})
+
+	for _, id := range dead {
+		value, _ := chain.Get(id)
+		// Only the snapshots taken before the version was deleted could see it.
+		below := d.transaction(value.txEndId).commitId
+		d.evictedBelow[key] = max(d.evictedBelow[key], below)
+		chain.Delete(id)
+	}
+}
+
+// Deletes the key in the transaction, returns false if it has no visible
+// version.
+func (d *Database) delete(t *Transaction, key string) bool {
+	if !d.markDeleted(t, key) {
+		return false
+	}
+
+	t.writeset.Insert(key)
+	return true
+}
+
+// Reports whether a transaction concurrent to t, one that was in progress when
+// t started or that started after it, created or deleted a version of the key.
+func (d *Database) hasConcurrentWrite(t *Transaction, key string) bool {
+	concurrent := func(id uint64) bool {
+		return id > 0 && id != t.id && (id > t.id || t.inprogress.Contains(id))
+	}
+
+	chain, ok := d.store[key]
+	if !ok {
+		return false
+	}
+
+	found := false
+	chain.Reverse(func(_ uint64, value Value) bool {
+		found = concurrent(value.txStartId) || concurrent(value.txEndId)
+		return !found
+	})
+
+	return found
+}
+
+// A dependency edge between two transactions in the serialization graph.
+type Dependency struct {
+	From uint64
+	To   uint64
+	// One of "ww" (From wrote a key that To overwrote), "wr" (To read a key
+	// written by From) or "rw" (From read a key that To overwrote without
+	// seeing the write).
+	Kind string
+}
+
+// Returns the dependency edges among the transactions that are not aborted,
+// derived from their readsets and writesets. Transactions are assumed to be
+// ordered by their ids, and a transaction that was in progress when another
+// started is assumed to be invisible to it, as in snapshot isolation.
+func (d *Database) SerializationGraph() []Dependency {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.serializationGraph()
+}
+
+func (d *Database) serializationGraph() []Dependency {
+	txs := []*Transaction{}
+	iter := d.transactions.Iter()
+	for ok := iter.First(); ok; ok = iter.Next() {
+		if iter.Value().state != TransactionStateAborted {
+			txs = append(txs, iter.Value())
+		}
+	}
+
+	edges := []Dependency{}
+	for i := range txs {
+		for j := i + 1; j < len(txs); j++ {
+			t1, t2 := txs[i], txs[j]
+
+			if setsShareItem(t1.writeset, t2.writeset) {
+				edges = append(edges, Dependency{From: t1.id, To: t2.id, Kind: "ww"})
+			}
+
+			if setsShareItem(t1.writeset, t2.readset) {
+				if t2.inprogress.Contains(t1.id) {
+					// t2 could not see the write so it must come before t1.
+					edges = append(edges, Dependency{From: t2.id, To: t1.id, Kind: "rw"})
+				} else {
+					edges = append(edges, Dependency{From: t1.id, To: t2.id, Kind: "wr"})
+				}
+			}
+
+			if setsShareItem(t1.readset, t2.writeset) {
+				edges = append(edges, Dependency{From: t1.id, To: t2.id, Kind: "rw"})
+			}
+		}
+	}
+
+	return edges
+}
+
+type Connection struct {
+	tx *Transaction
+	// The namespace selected with "use", and the database it belongs to.
+	db   *Database
+	root *Database
+
+	// When set, data commands issued outside a transaction run in a
+	// transaction of their own that is committed immediately.
+	Autocommit bool
+}
+
+type ResultKind uint8
+
+const (
+	ResultKindOk ResultKind = iota
+	// The key has no visible value.
+	ResultKindNotFound
+	// The value is the id of the transaction just started.
+	ResultKindTxId
+)
+
+type Result struct {
+	Value string
+	// Whether the command found its key, so that a key holding the empty
+	// string can be told apart from a missing one.
+	Found bool
+	Kind  ResultKind
+}
+
+// Executes the command and describes its result. A missing key is reported as
+// a result of kind ResultKindNotFound rather than as ErrNoSuchKey.
+func (c *Connection) ExecCommand(command string, args []string) (Result, error) {
+	return c.exec(command, args)
+}
+
+func newResult(command string, res string, err error) (Result, error) {
+	if errors.Is(err, ErrNoSuchKey) {
+		return Result{Kind: ResultKindNotFound}, nil
+	}
+
+	if err != nil {
+		return Result{}, err
+	}
+
+	if command == "begin" {
+		return Result{Value: res, Found: true, Kind: ResultKindTxId}, nil
+	}
+
+	return Result{Value: res, Found: true, Kind: ResultKindOk}, nil
+}
+
+// Executes the command, returning ErrNoSuchKey for a missing key.
+func (c *Connection) execCommand(command string, args []string) (string, error) {
+	res, err := c.ExecCommand(command, args)
+	if err == nil && res.Kind == ResultKindNotFound {
+		return "", ErrNoSuchKey
+	}
+
+	return res.Value, err
+}
+
+// Commands that can run without an open transaction.
+var transactionlessCommands = []string{"graph", "begin", "getas", "getastime", "history", "set_isolation", "kill", "flushall", "status", "txlist", "dumpkey", "chaininfo", "memstats", "oldesttx", "use"}
+
+// Commands that only make sense inside an explicit transaction, and so are
+// never autocommitted.
+var transactionControlCommands = []string{"commit", "abort", "prepare", "precommit", "savepoint", "rollback"}
+
+// Executes the semicolon-separated statements of the script in order while
+// holding the database lock, so no other connection runs in between, and stops
+// at the first error. A script that doesn't begin a transaction when none is
+// open runs in an implicit one, which is committed at the end of the script
+// or aborted on error.
+func (c *Connection) ExecScript(script string) ([]Result, error) {
+	statements := [][]string{}
+	for _, statement := range strings.Split(script, ";") {
+		if fields := strings.Fields(statement); len(fields) > 0 {
+			statements = append(statements, fields)
+		}
+	}
+
+	// The whole script runs under the lock of the namespace it starts in.
+	for _, fields := range statements {
+		if fields[0] == "use" {
+			return nil, fmt.Errorf("use in a script: %w", ErrTransactionInProgress)
+		}
+	}
+
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	implicit := c.tx == nil && (len(statements) == 0 || statements[0][0] != "begin")
+	if implicit {
+		if _, err := c.execLocked("begin", nil); err != nil {
+			return nil, err
+		}
+	}
+
+	results := []Result{}
+	for _, fields := range statements {
+		res, err := c.execLocked(fields[0], fields[1:])
+		if err != nil {
+			if implicit && c.tx != nil {
+				c.db.completeTransaction(c.tx, TransactionStateAborted)
+				c.tx = nil
+			}
+			return results, err
+		}
+
+		results = append(results, res)
+	}
+
+	if implicit && c.tx != nil {
+		err := c.db.completeTransaction(c.tx, TransactionStateCommitted)
+		c.tx = nil
+		return results, err
+	}
+
+	return results, nil
+}
+
+// The number of arguments each command requires, checked before running it.
+// Commands taking no arguments, or any number of them, are left out.
+var minArgs = map[string]int{
+	"savepoint": 1, "rollback": 1,
+	"get": 1, "getas": 2, "getastime": 2, "getraw": 1, "getv": 1, "getmeta": 1, "history": 1, "dumpkey": 1, "chaininfo": 1, "assert": 2, "sametx": 1,
+	"exists": 1, "isnull": 1, "checkkeys": 1, "delprefix": 1, "versions": 2, "scan": 1, "range": 2,
+	"set": 2, "setraw": 2, "delete": 1, "lock": 1, "setex": 3, "touch": 2, "cas": 3,
+	"incr": 2, "transfer": 3, "getset": 2, "copy": 2, "rename": 2, "append": 2, "delif": 2, "setv": 3,
+	"set_isolation": 1, "kill": 1, "use": 1,
+}
+
+func (c *Connection) exec(command string, args []string) (Result, error) {
+	if c.db.stepGate != nil {
+		defer c.db.stepGate.wait(c)()
+	}
+
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	return c.execLocked(command, args)
+}
+
+func (c *Connection) execLocked(command string, args []string) (Result, error) {
+	debug(command, args)
+
+	if c.db.closed {
+		c.tx = nil
+		return Result{}, ErrDatabaseClosed
+	}
+
+	if c.tx != nil && c.tx.abortReason != nil {
+		err := c.tx.abortReason
+		c.tx = nil
+		return Result{}, err
+	}
+
+	// Only the outcome of a prepared transaction can be decided.
+	if c.tx != nil && c.tx.state == TransactionStatePrepared && command != "commit" && command != "abort" {
+		return Result{}, ErrTransactionPrepared
+	}
+
+	if len(args) < minArgs[command] {
+		return Result{}, fmt.Errorf("%s: %w", command, ErrWrongArgs)
+	}
+
+	if c.tx == nil && !slices.Contains(transactionlessCommands, command) {
+		if !c.Autocommit || slices.Contains(transactionControlCommands, command) {
+			return Result{}, ErrNoTransaction
+		}
+
+		return c.autocommit(command, args)
+	}
+
+	return c.dispatch(command, args)
+}
+
+// Runs the command in its own transaction at the default isolation level,
+// committing it right away. A missing key still commits the transaction.
+func (c *Connection) autocommit(command string, args []string) (Result, error) {
+	tx, err := c.db.newTransaction(c.db.defaultIsolation, false)
+	if err != nil {
+		return Result{}, err
+	}
+
+	c.tx = tx
+	res, err := c.dispatch(command, args)
+	c.tx = nil
+
+	// The command may have already aborted the transaction on a conflict.
+	if tx.state != TransactionStateInProgress {
+		return Result{}, err
+	}
+
+	if err != nil {
+		c.db.completeTransaction(tx, TransactionStateAborted)
+		return Result{}, err
+	}
+
+	if err := c.db.completeTransaction(tx, TransactionStateCommitted); err != nil {
+		return Result{}, err
+	}
+
+	return res, nil
+}
+
+// Runs the command in the connection's transaction, if it needs one.
+func (c *Connection) dispatch(command string, args []string) (Result, error) {
+	if command == "getset" {
+		return c.getset(args[0], args[1])
+	}
+
+	res, err := c.runCommand(command, args)
+	return newResult(command, res, err)
+}
+
+// Sets the key and returns its previous value. The value is set even when the
+// key is missing, which is reported as a result that isn't Found.
+func (c *Connection) getset(key string, value string) (Result, error) {
+	c.db.assertValidTransaction(c.tx)
+	if err := c.checkWrite(key); err != nil {
+		return Result{}, err
+	}
+
+	c.tx.recordRead(key)
+	previous, found := c.db.get(c.tx, key)
+	c.db.set(c.tx, key, value)
+	return Result{Value: previous.value, Found: found, Kind: ResultKindOk}, nil
+}
+
+func (c *Connection) runCommand(command string, args []string) (string, error) {
+	if command == "graph" {
+		lines := []string{}
+		for _, edge := range c.db.serializationGraph() {
+			lines = append(lines, fmt.Sprintf("%d -%s-> %d", edge.From, edge.Kind, edge.To))
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	if command == "txlist" {
+		lines := []string{}
+		for _, info := range c.db.inProgressTransactions() {
+			lines = append(lines, fmt.Sprintf("id=%d isolation=%s reads=%d writes=%d",
+				info.Id, info.Isolation, info.Reads, info.Writes))
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	if command == "status" {
+		if c.tx == nil {
+			return "no transaction", nil
+		}
+
+		return fmt.Sprintf("id=%d isolation=%s state=%s", c.tx.id, c.tx.isolation, c.tx.state), nil
+	}
+
+	if command == "flushall" {
+		return "", c.db.flushAll()
+	}
+
+	if command == "oldesttx" {
+		return strconv.FormatUint(c.db.oldestActiveTransaction(), 10), nil
+	}
+
+	if command == "memstats" {
+		return c.db.memStats().String(), nil
+	}
+
+	if command == "kill" {
+		id, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return "", ErrNoSuchTransaction
+		}
+
+		return "", c.db.abortTransaction(id)
+	}
+
+	// Transactions don't span namespaces, so switching is only allowed
+	// between them.
+	if command == "use" {
+		if c.tx != nil {
+			return "", ErrTransactionInProgress
+		}
+
+		// The lock of the database is already held when in it.
+		if c.db == c.root {
+			c.db = c.root.namespace(args[0])
+		} else {
+			c.db = c.root.Namespace(args[0])
+		}
+		return "", nil
+	}
+
+	if command == "set_isolation" {
+		if len(args) != 1 {
+			return "", ErrWrongArgs
+		}
+
+		level, ok := parseIsolationLevel(args[0])
+		if !ok {
+			return "", ErrUnknownIsolation
+		}
+
+		c.db.defaultIsolation = level
+		return "", nil
+	}
+
+	if command == "begin" {
+		if c.tx != nil {
+			return "", ErrTransactionInProgress
+		}
+
+		// Optionally followed by an isolation level, readonly, and/or
+		// no_read_your_writes, or by a profile setting the first two.
+		isolation := c.db.defaultIsolation
+		readonly, readYourWrites := false, true
+		for i := 0; i < len(args); i += 1 {
+			arg := args[i]
+			if arg == "profile" {
+				if i+1 == len(args) {
+					return "", fmt.Errorf("begin profile: %w", ErrWrongArgs)
+				}
+
+				i += 1
+				p, ok := c.db.profiles[args[i]]
+				if !ok {
+					return "", ErrNoSuchProfile
+				}
+				isolation, readonly = p.isolation, p.readonly
+				continue
+			}
+
+			if arg == "readonly" {
+				readonly = true
+				continue
+			}
+
+			if arg == "no_read_your_writes" {
+				readYourWrites = false
+				continue
+			}
+
+			level, ok := parseIsolationLevel(arg)
+			if !ok {
+				return "", ErrUnknownIsolation
+			}
+			isolation = level
+		}
+
+		tx, err := c.db.newTransaction(isolation, readonly)
+		if err != nil {
+			return "", err
+		}
+
+		tx.readYourWrites = readYourWrites
+		c.tx = tx
+		return fmt.Sprintf("%d", c.tx.id), nil
+	}
+
+	if command == "abort" {
+		err := c.db.completeTransaction(c.tx, TransactionStateAborted)
+		c.tx = nil
+		return "", err
+	}
+
+	if command == "commit" {
+		err := c.db.completeTransaction(c.tx, TransactionStateCommitted)
+		c.tx = nil
+		return "", err
+	}
+
+	// The first phase of a two-phase commit, see Connection.Prepare.
+	if command == "prepare" {
+		err := c.db.prepareTransaction(c.tx)
+		if err != nil {
+			c.tx = nil
+		}
+		return "", err
+	}
+
+	// Unlike precommit, conflicts with prepared transactions don't count, as
+	// those may still abort.
+	if command == "doomed" {
+		c.db.assertValidTransaction(c.tx)
+
+		if c.db.committedConflict(c.tx) != nil {
+			return "1", nil
+		}
+		return "0", nil
+	}
+
+	if command == "precommit" {
+		c.db.assertValidTransaction(c.tx)
+
+		// Only reports whether commit would currently fail, a transaction
+		// committing in the meantime may still make it fail.
+		if err := c.db.commitConflict(c.tx); err != nil {
+			if err.Err == ErrWriteWriteConflict {
+				return "write-write", nil
+			}
+			return "read-write", nil
+		}
+		return "ok", nil
+	}
+
+	if command == "savepoint" {
+		c.db.assertValidTransaction(c.tx)
+		c.tx.savepoints = append(c.tx.savepoints, savepoint{
+			name:     args[0],
+			undo:     len(c.tx.undo),
+			writeset: *c.tx.writeset.Copy(),
+			readset:  *c.tx.readset.Copy(),
+
+			predicates: len(c.tx.predicates),
+		})
+		return "", nil
+	}
+
+	if command == "rollback" {
+		c.db.assertValidTransaction(c.tx)
+		for i := len(c.tx.savepoints) - 1; i >= 0; i -= 1 {
+			sp := c.tx.savepoints[i]
+			if sp.name != args[0] {
+				continue
+			}
+
+			// The savepoint itself is kept so it can be rolled back to again,
+			// but the ones created after it are released.
+			c.db.rollback(c.tx, sp.undo)
+			c.tx.writeset = *sp.writeset.Copy()
+			c.tx.readset = *sp.readset.Copy()
+			c.tx.predicates = c.tx.predicates[:sp.predicates]
+			c.tx.savepoints = c.tx.savepoints[:i+1]
+			return "", nil
+		}
+
+		return "", ErrNoSuchSavepoint
+	}
+
+	if command == "get" {
+		c.db.assertValidTransaction(c.tx)
+		key := args[0]
+		if len(args) > 1 && args[1] == "status" {
+			return c.getStatus(key).String(), nil
+		}
+
+		c.tx.recordRead(key)
+		if value, ok := c.db.get(c.tx, key); ok {
+			return value.value, nil
+		}
+
+		return "", ErrNoSuchKey
+	}
+
+	// Compares the value of the key with the expected one, NIL standing for a
+	// missing key, for scripting anomalies in the REPL. A mismatch is reported
+	// in the result rather than as an error, leaving the transaction open.
+	if command == "assert" {
+		actual, err := c.runCommand("get", args[:1])
+		if errors.Is(err, ErrNoSuchKey) {
+			actual, err = "NIL", nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if actual != args[1] {
+			return fmt.Sprintf("FAIL %s: expected %s, got %s", args[0], args[1], actual), nil
+		}
+		return "OK", nil
+	}
+
+	if command == "getas" {
+		id, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return "", ErrNoSuchTransaction
+		}
+
+		// Vacuum forgets the finished transactions no in-progress one needs, so
+		// only those can be read as of afterwards.
+		tx, ok := c.db.transactions.Get(id)
+		if !ok {
+			return "", ErrNoSuchTransaction
+		}
+
+		// Read from the snapshot the transaction had when it started plus its
+		// own writes, regardless of its actual isolation level.
+		past := *tx
+		past.isolation = max(past.isolation, IsolationLevelRepeatableRead)
+		if past.snapshot < c.db.evictedBelow[args[1]] {
+			return "", ErrHistoryUnavailable
+		}
+
+		if value, ok := c.db.get(&past, args[1]); ok {
+			return value.value, nil
+		}
+
+		return "", ErrNoSuchKey
+	}
+
+	if command == "getastime" {
+		at, err := time.Parse(time.RFC3339, args[0])
+		if err != nil {
+			return "", ErrInvalidTime
+		}
+
+		snapshot, err := c.db.commitIdAt(at)
+		if err != nil {
+			return "", err
+		}
+		if snapshot < c.db.evictedBelow[args[1]] {
+			return "", ErrHistoryUnavailable
+		}
+
+		past := &Transaction{id: c.db.nextTransactionId, isolation: IsolationLevelRepeatableRead, snapshot: snapshot}
+		if value, ok := c.db.visibleVersion(past, args[1]); ok {
+			return value.value, nil
+		}
+
+		return "", ErrNoSuchKey
+	}
+
+	if command == "versions" {
+		c.db.assertValidTransaction(c.tx)
+		key := args[0]
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return "", ErrNotPositive
+		}
+
+		// Unlike history, only the versions written by transactions visible
+		// to this one are listed, including the ones overwritten or deleted
+		// since, newest first.
+		c.tx.recordRead(key)
+		values := []string{}
+		c.db.descend(c.tx, key, func(value Value) bool {
+			written := value
+			written.txEndId = 0
+			if c.db.isVisible(c.tx, written) {
+				values = append(values, value.value)
+			}
+			return len(values) < n
+		})
+
+		return strings.Join(values, "\n"), nil
+	}
+
+	if command == "dumpkey" {
+		return c.db.dumpKey(args[0])
+	}
+
+	// Summarizes the key's chain for spotting keys in need of vacuum, the
+	// invisible versions being the ones a transaction starting now wouldn't
+	// see. Not recorded as a read.
+	if command == "chaininfo" {
+		chain, ok := c.db.store[args[0]]
+		if !ok {
+			return "", ErrNoSuchKey
+		}
+
+		oldest, _, _ := chain.Min()
+		newest, _, _ := chain.Max()
+		t := &Transaction{id: c.db.nextTransactionId, isolation: IsolationLevelReadCommitted}
+		invisible := 0
+		chain.Scan(func(_ uint64, value Value) bool {
+			if !c.db.isVisible(t, value) {
+				invisible += 1
+			}
+			return true
+		})
+
+		return fmt.Sprintf("versions=%d oldest=%d newest=%d invisible=%d", chain.Len(), oldest, newest, invisible), nil
+	}
+
+	if command == "history" {
+		lines := []string{}
+		if chain, ok := c.db.store[args[0]]; ok {
+			chain.Scan(func(_ uint64, value Value) bool {
+				lines = append(lines, fmt.Sprintf("start=%d end=%d state=%s value=%s",
+					value.txStartId, value.txEndId, c.db.transaction(value.txStartId).state, value.value))
+				return true
+			})
+		}
+
+		return strings.Join(lines, "\n"), nil
+	}
+
+	if command == "getraw" {
+		c.db.assertValidTransaction(c.tx)
+		key := args[0]
+
+		// Length-prefixed so that the value may contain newlines.
+		c.tx.recordRead(key)
+		if value, ok := c.db.get(c.tx, key); ok {
+			return fmt.Sprintf("%d\n%s", len(value.value), value.value), nil
+		}
+
+		return "", ErrNoSuchKey
+	}
+
+	// The keys the transaction set or deleted so far, sorted.
+	if command == "dirty" {
+		c.db.assertValidTransaction(c.tx)
+		return strings.Join(c.tx.writeset.Keys(), "\n"), nil
+	}
+
+	// Lists the keys written by transactions that committed since this one
+	// began, which would fail its commit under snapshot isolation if it wrote
+	// them, so that it can give up before doing the work.
+	if command == "checkkeys" {
+		c.db.assertValidTransaction(c.tx)
+
+		conflicts := []string{}
+		for _, key := range args {
+			if c.db.lastWrite[key] > c.tx.snapshot {
+				conflicts = append(conflicts, key)
+			}
+		}
+
+		return strings.Join(conflicts, "\n"), nil
+	}
+
+	// An empty value is present like any other, and only a missing key is
+	// null, which get alone can't tell apart when only its value is seen.
+	if command == "exists" || command == "isnull" {
+		c.db.assertValidTransaction(c.tx)
+		key := args[0]
+
+		c.tx.recordRead(key)
+		_, ok := c.db.get(c.tx, key)
+		if ok == (command == "exists") {
+			return "1", nil
+		}
+
+		return "0", nil
+	}
+
+	// setraw is set for a value that the REPL reads as raw bytes rather than
+	// as an argument, as ExecCommand takes any value as it is.
+	if command == "set" || command == "setraw" || command == "delete" {
+		c.db.assertValidTransaction(c.tx)
+		key := args[0]
+		if err := c.checkWrite(key); err != nil {
+			return "", err
+		}
+
+		if command != "delete" {
+			value := args[1]
+			c.db.set(c.tx, key, value)
+			return value, nil
+		}
+
+		if !c.db.delete(c.tx, key) && !c.db.DeleteIdempotent {
+			return "", ErrNoSuchKey
+		}
+
+		// Delete ok.
+		return "", nil
+	}
+
+	if command == "mget" {
+		c.db.assertValidTransaction(c.tx)
+
+		// Missing keys are empty lines.
+		values := []string{}
+		for _, key := range args {
+			c.tx.recordRead(key)
+			value, _ := c.db.get(c.tx, key)
+			values = append(values, value.value)
+		}
+
+		return strings.Join(values, "\n"), nil
+	}
+
+	if command == "sametx" {
+		c.db.assertValidTransaction(c.tx)
+
+		// A missing key wasn't written by any transaction.
+		writers := []uint64{}
+		for _, key := range args {
+			c.tx.recordRead(key)
+			value, ok := c.db.get(c.tx, key)
+			if !ok {
+				return "0", nil
+			}
+			writers = append(writers, value.txStartId)
+		}
+
+		if len(slices.Compact(writers)) > 1 {
+			return "0", nil
+		}
+		return "1", nil
+	}
+
+	if command == "snapshot" {
+		c.db.assertValidTransaction(c.tx)
+
+		// Like mget, but as key=value pairs so that missing keys, which are
+		// left out, can be told apart from empty values. All the keys enter
+		// the readset and are read in the same command, so no commit can land
+		// between the reads even under read committed.
+		pairs := []string{}
+		for _, key := range args {
+			c.tx.recordRead(key)
+			if value, ok := c.db.get(c.tx, key); ok {
+				pairs = append(pairs, key+"="+value.value)
+			}
+		}
+
+		return strings.Join(pairs, "\n"), nil
+	}
+
+	if command == "mset" {
+		c.db.assertValidTransaction(c.tx)
+		if len(args)%2 != 0 {
+			return "", ErrWrongArgs
+		}
+
+		keys := []string{}
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		if err := c.checkWrite(keys...); err != nil {
+			return "", err
+		}
+
+		for i := 0; i < len(args); i += 2 {
+			c.db.set(c.tx, args[i], args[i+1])
+		}
+
+		return "", nil
+	}
+
+	if command == "lock" {
+		c.db.assertValidTransaction(c.tx)
+		key := args[0]
+		if err := c.checkWrite(key); err != nil {
+			return "", err
+		}
+
+		// With "wait" the key is also locked exclusively until the transaction
+		// ends, blocking while another transaction holds it.
+		if len(args) > 1 && args[1] == "wait" {
+			if err := c.db.lockWait(c.tx, key); err != nil {
+				c.tx = nil
+				return "", err
+			}
+		}
+
+		// Like SELECT ... FOR UPDATE the key is both read and written without
+		// changing its value, so another transaction locking or writing the
+		// same key conflicts with this one on commit.
+		c.tx.recordRead(key)
+		c.tx.writeset.Insert(key)
+		return "", nil
+	}
+
+	if command == "setex" {
+		c.db.assertValidTransaction(c.tx)
+		key, value := args[0], args[1]
+		if err := c.checkWrite(key); err != nil {
+			return "", err
+		}
+
+		ttl, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "", ErrNotInteger
+		}
+
+		c.db.setExpiring(c.tx, key, value, c.db.now().Add(time.Duration(ttl)*time.Second))
+		return value, nil
+	}
+
+	if command == "getv" {
+		c.db.assertValidTransaction(c.tx)
+		key := args[0]
+
+		c.tx.recordRead(key)
+		if value, ok := c.db.get(c.tx, key); ok {
+			return fmt.Sprintf("%s@%d", value.value, value.txStartId), nil
+		}
+
+		return "", ErrNoSuchKey
+	}
+
+	// Like getv, and whether a newer version, visible or not, was written
+	// since.
+	if command == "getmeta" {
+		c.db.assertValidTransaction(c.tx)
+		key := args[0]
+
+		c.tx.recordRead(key)
+		value, ok := c.db.get(c.tx, key)
+		if !ok {
+			return "", ErrNoSuchKey
+		}
+
+		newest, _, _ := c.db.chain(key).Max()
+		return fmt.Sprintf("value=%s start=%d latest=%t", value.value, value.txStartId, newest == value.txStartId), nil
+	}
+
+	if command == "setv" {
+		c.db.assertValidTransaction(c.tx)
+		key, value := args[0], args[1]
+		if err := c.checkWrite(key); err != nil {
+			return "", err
+		}
+
+		expected, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return "", ErrNotInteger
+		}
+
+		// A missing key has version 0.
+		c.tx.recordRead(key)
+		current, _ := c.db.get(c.tx, key)
+		if current.txStartId != expected {
+			return "", ErrStaleVersion
+		}
+
+		c.db.set(c.tx, key, value)
+		return value, nil
+	}
+
+	if command == "touch" {
+		c.db.assertValidTransaction(c.tx)
+		key := args[0]
+		if err := c.checkWrite(key); err != nil {
+			return "", err
+		}
+
+		ttl, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "", ErrNotInteger
+		}
+
+		c.tx.recordRead(key)
+		current, ok := c.db.get(c.tx, key)
+		if !ok {
+			return "", ErrNoSuchKey
+		}
+
+		// Changing the expiry of the current version in place would change
+		// what concurrent snapshots seeing it observe, so the value is written
+		// again as a new version with the new expiry, a write like any other.
+		c.db.setExpiring(c.tx, key, current.value, c.db.now().Add(time.Duration(ttl)*time.Second))
+		return current.value, nil
+	}
+
+	if command == "cas" {
+		c.db.assertValidTransaction(c.tx)
+		key, expected, value := args[0], args[1], args[2]
+		if err := c.checkWrite(key); err != nil {
+			return "", err
+		}
+
+		// A missing key compares equal to the empty string.
+		c.tx.recordRead(key)
+		current, _ := c.db.get(c.tx, key)
+		if current.value != expected {
+			return "", ErrCasMismatch
+		}
+
+		c.db.set(c.tx, key, value)
+		return value, nil
+	}
+
+	if command == "incr" {
+		c.db.assertValidTransaction(c.tx)
+		key := args[0]
+		if err := c.checkWrite(key); err != nil {
+			return "", err
+		}
+
+		delta, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "", ErrNotInteger
+		}
+
+		// A missing key counts from zero.
+		c.tx.recordRead(key)
+		base := int64(0)
+		if current, ok := c.db.get(c.tx, key); ok {
+			base, err = strconv.ParseInt(current.value, 10, 64)
+			if err != nil {
+				return "", ErrNotInteger
+			}
+		}
+
+		if (delta > 0 && base > math.MaxInt64-delta) || (delta < 0 && base < math.MinInt64-delta) {
+			return "", ErrOverflow
+		}
+
+		value := strconv.FormatInt(base+delta, 10)
+		c.db.set(c.tx, key, value)
+		return value, nil
+	}
+
+	// Moves a positive amount from one integer key to another, missing keys
+	// counting as zero, and returns their new values. Both keys are read and
+	// written, so a concurrent transfer touching either makes serializable
+	// transactions conflict.
+	if command == "transfer" {
+		c.db.assertValidTransaction(c.tx)
+		from, to := args[0], args[1]
+		if err := c.checkWrite(from, to); err != nil {
+			return "", err
+		}
+
+		amount, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || amount <= 0 {
+			return "", ErrNotPositive
+		}
+
+		balance := func(key string) (int64, error) {
+			c.tx.recordRead(key)
+			value, ok := c.db.get(c.tx, key)
+			if !ok {
+				return 0, nil
+			}
+			n, err := strconv.ParseInt(value.value, 10, 64)
+			if err != nil {
+				return 0, ErrNotInteger
+			}
+			return n, nil
+		}
+
+		fromBalance, err := balance(from)
+		if err != nil {
+			return "", err
+		}
+		toBalance, err := balance(to)
+		if err != nil {
+			return "", err
+		}
+		if fromBalance < amount {
+			return "", ErrInsufficientFunds
+		}
+
+		// A transfer to the same key leaves it unchanged.
+		fromValue := strconv.FormatInt(fromBalance-amount, 10)
+		toValue := strconv.FormatInt(toBalance+amount, 10)
+		if from == to {
+			fromValue = strconv.FormatInt(fromBalance, 10)
+			toValue = fromValue
+		}
+
+		c.db.set(c.tx, from, fromValue)
+		c.db.set(c.tx, to, toValue)
+		return fromValue + "\n" + toValue, nil
+	}
+
+	if command == "delif" {
+		c.db.assertValidTransaction(c.tx)
+		key, expected := args[0], args[1]
+		if err := c.checkWrite(key); err != nil {
+			return "", err
+		}
+
+		c.tx.recordRead(key)
+		current, ok := c.db.get(c.tx, key)
+		if !ok {
+			return "", ErrNoSuchKey
+		}
+
+		if current.value != expected {
+			return "", ErrConditionFailed
+		}
+
+		c.db.delete(c.tx, key)
+		return "", nil
+	}
+
+	// A missing key is appended to as if empty, like Redis APPEND.
+	if command == "append" {
+		c.db.assertValidTransaction(c.tx)
+		key, suffix := args[0], args[1]
+		if err := c.checkWrite(key); err != nil {
+			return "", err
+		}
+
+		c.tx.recordRead(key)
+		value, _ := c.db.get(c.tx, key)
+		appended := value.value + suffix
+		c.db.set(c.tx, key, appended)
+		return strconv.Itoa(len(appended)), nil
+	}
+
+	// Like copy followed by deleting the source, overwriting the destination
+	// if it exists. Renaming a key to itself leaves it as is.
+	if command == "rename" {
+		c.db.assertValidTransaction(c.tx)
+		src, dst := args[0], args[1]
+		if err := c.checkWrite(src, dst); err != nil {
+			return "", err
+		}
+
+		c.tx.recordRead(src)
+		value, ok := c.db.get(c.tx, src)
+		if !ok {
+			return "", ErrNoSuchKey
+		}
+
+		if src != dst {
+			c.db.set(c.tx, dst, value.value)
+			c.db.delete(c.tx, src)
+		}
+		return value.value, nil
+	}
+
+	if command == "copy" {
+		c.db.assertValidTransaction(c.tx)
+		src, dst := args[0], args[1]
+		if err := c.checkWrite(dst); err != nil {
+			return "", err
+		}
+
+		c.tx.recordRead(src)
+		value, ok := c.db.get(c.tx, src)
+		if !ok {
+			return "", ErrNoSuchKey
+		}
+
+		c.db.set(c.tx, dst, value.value)
+		return value.value, nil
+	}
+
+	if command == "scan" {
+		c.db.assertValidTransaction(c.tx)
+		prefix := args[0]
+
+		return c.visiblePairs(func(key string) bool {
+			return strings.HasPrefix(key, prefix)
+		}), nil
+	}
+
+	// Reads the prefix like scan, so that a concurrent insert into it is a
+	// conflict for serializable transactions, and deletes what it found.
+	if command == "delprefix" {
+		c.db.assertValidTransaction(c.tx)
+		prefix := args[0]
+
+		keys := []string{}
+		c.readRange(func(key string) bool {
+			return strings.HasPrefix(key, prefix)
+		}, func(key string, _ Value) {
+			keys = append(keys, key)
+		})
+
+		if err := c.checkWrite(keys...); err != nil {
+			return "", err
+		}
+		for _, key := range keys {
+			c.db.delete(c.tx, key)
+		}
+
+		return strconv.Itoa(len(keys)), nil
+	}
+
+	if command == "range" {
+		c.db.assertValidTransaction(c.tx)
+		start, end := args[0], args[1]
+
+		// The store keys are sorted on each call rather than kept in an
+		// ordered index, which keeps writes cheap at the expense of ranges.
+		return c.visiblePairs(func(key string) bool {
+			return start <= key && key < end
+		}), nil
+	}
+
+	if command == "keys" {
+		c.db.assertValidTransaction(c.tx)
+
+		keys := []string{}
+		c.readRange(func(string) bool { return true }, func(key string, _ Value) {
+			keys = append(keys, key)
+		})
+
+		return strings.Join(keys, "\n"), nil
+	}
+
+	if command == "count" {
+		c.db.assertValidTransaction(c.tx)
+
+		// Like keys, this reads the whole keyspace, so every key enters the
+		// readset and a predicate matching any key is recorded to catch
+		// inserts under serializable isolation. Keys are visited unsorted as
+		// their order doesn't matter.
+		c.tx.recordPredicate(func(string) bool { return true })
+		count := 0
+		for key := range c.db.store {
+			c.tx.recordRead(key)
+			if _, ok := c.db.get(c.tx, key); ok {
+				count += 1
+			}
+		}
+
+		return strconv.Itoa(count), nil
+	}
+
+	return "", errors.New("unimplemented")
+}
+
+// Calls fn with the keys accepted by match that have a visible value, in
+// ascending order. All the matching keys enter the readset, even the ones
+// without a visible value, and the match itself is recorded as a predicate so
+// that a concurrent insert of a new matching key is a conflict too.
+func (c *Connection) readRange(match func(key string) bool, fn func(key string, value Value)) {
+	c.tx.recordPredicate(match)
+	for _, key := range c.db.keys(match) {
+		c.tx.recordRead(key)
+		if value, ok := c.db.get(c.tx, key); ok {
+			fn(key, value)
+		}
+	}
+}
+
+// Returns the visible keys accepted by match as newline-separated key=value
+// pairs.
+func (c *Connection) visiblePairs(match func(key string) bool) string {
+	pairs := []string{}
+	c.readRange(match, func(key string, value Value) {
+		pairs = append(pairs, key+"="+value.value)
+	})
+
+	return strings.Join(pairs, "\n")
+}
+
+// Iterates over the keys visible to a transaction in ascending order. The keys
+// are the ones stored when the cursor was created, so keys inserted afterwards
+// are never yielded, but whether each key is visible and its value are decided
+// when the cursor reaches it.
+type Cursor struct {
+	c     *Connection
+	tx    *Transaction
+	keys  []string
+	key   string
+	value string
+}
+
+// Returns a cursor over the keys visible to the connection's transaction. Like
+// the keys command, it reads the whole keyspace.
+func (c *Connection) Cursor() (*Cursor, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	if c.tx == nil {
+		return nil, ErrNoTransaction
+	}
+
+	c.tx.recordPredicate(func(string) bool { return true })
+	return &Cursor{c: c, tx: c.tx, keys: c.db.keys(func(string) bool { return true })}, nil
+}
+
+// Advances to the next visible key, returning false when there are no more or
+// the transaction has ended.
+func (cur *Cursor) Next() bool {
+	db := cur.c.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for len(cur.keys) > 0 && cur.tx.state == TransactionStateInProgress {
+		key := cur.keys[0]
+		cur.keys = cur.keys[1:]
+
+		cur.tx.recordRead(key)
+		if value, ok := db.get(cur.tx, key); ok {
+			cur.key, cur.value = key, value.value
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cur *Cursor) Key() string {
+	return cur.key
+}
+
+func (cur *Cursor) Value() string {
+	return cur.value
+}
+
+// Verifies that the connection's transaction may write all the keys of a
+// command, before it writes any of them so that a command is never left half
+// done. When FirstUpdaterWins is set and a concurrent transaction already
+// wrote one of the keys, the transaction is aborted.
+func (c *Connection) checkWrite(keys ...string) error {
+	if c.tx.readonly {
+		return ErrReadOnly
+	}
+
+	if c.db.MaxWritesPerTx > 0 {
+		added := btree.Set[string]{}
+		for _, key := range keys {
+			if !c.tx.writeset.Contains(key) {
+				added.Insert(key)
+			}
+		}
+		if c.tx.writeset.Len()+added.Len() > c.db.MaxWritesPerTx {
+			return ErrWriteLimit
+		}
+	}
+
+	for _, key := range keys {
+		if c.db.FirstUpdaterWins && c.tx.isolation == IsolationLevelSnapshot && c.db.hasConcurrentWrite(c.tx, key) {
+			c.db.stats.WriteWriteConflicts += 1
+			c.db.log(Event{Kind: EventConflict, TxId: c.tx.id, Key: key, Err: ErrWriteWriteConflict})
+			c.db.endTransaction(c.tx, TransactionStateAborted)
+			c.tx = nil
+			return ErrWriteWriteConflict
+		}
+	}
+
+	return nil
+}
+
+// Prepares the connection's transaction to commit, the first phase of a
+// two-phase commit driven by an external coordinator. On success the
+// transaction can only be finished with Commit, which then can't fail, or
+// Rollback. On a conflict the transaction is aborted and the error returned.
+func (c *Connection) Prepare() error {
+	_, err := c.exec("prepare", nil)
+	return err
+}
+
+// Commits the connection's transaction, prepared or not.
+func (c *Connection) Commit() error {
+	_, err := c.exec("commit", nil)
+	return err
+}
+
+// Aborts the connection's transaction, prepared or not.
+func (c *Connection) Rollback() error {
+	_, err := c.exec("abort", nil)
+	return err
+}
+
+// Blocks until the latest committed value of the key equals value, returning
+// true, or until the timeout elapses, returning false. The value is checked
+// again each time a transaction writing the key commits.
+func (c *Connection) WaitForKey(key string, value string, timeout time.Duration) bool {
+	db := c.db
+	ch := db.Watch(key)
+	defer db.Unwatch(key, ch)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		if db.committedValueIs(key, value) {
+			return true
+		}
+
+		select {
+		case <-ch:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (d *Database) committedValueIs(key string, value string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// A read committed transaction that starts after every other one sees
+	// exactly the latest committed values.
+	t := &Transaction{id: d.nextTransactionId, isolation: IsolationLevelReadCommitted}
+	found, ok := d.visibleVersion(t, key)
+	return ok && found.value == value
+}
+
+// Reports whether the key is present, deleted, or never existed as seen by
+// the connection's transaction.
+func (c *Connection) GetStatus(key string) KeyStatus {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	return c.getStatus(key)
+}
+
+// Takes a new snapshot for the connection's repeatable read transaction, so
+// that its later reads see the writes of the transactions that were in
+// progress when it began and have committed since. This deliberately gives up
+// repeatable reads for the transaction from then on. Transactions that began
+// after it stay invisible, as visibility also follows the order of ids.
+// Stricter levels check conflicts against their snapshot, which a new one
+// would hide, and fail with ErrIsolationTooStrong.
+func (c *Connection) NewSnapshot() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	if c.tx == nil {
+		return ErrNoTransaction
+	}
+
+	if c.tx.isolation > IsolationLevelRepeatableRead {
+		return ErrIsolationTooStrong
+	}
+
+	inprogress := c.db.inprogress()
+	inprogress.Delete(c.tx.id)
+	c.tx.inprogress = inprogress
+	c.tx.snapshot = c.db.nextCommitId - 1
+	clear(c.tx.reads)
+	return nil
+}
+
+func (c *Connection) getStatus(key string) KeyStatus {
+	c.db.assertValidTransaction(c.tx)
+	c.tx.recordRead(key)
+	return c.db.keyStatus(c.tx, key)
+}
+
+func (c *Connection) mustExecCommand(cmd string, args []string) string {
+	res, err := c.execCommand(cmd, args)
+	assertEq(err, nil, "unexpected error")
+	return res
+}
+
+func (d *Database) newConnection() *Connection {
+	return &Connection{
+		tx:   nil,
+		db:   d,
+		root: d,
+	}
+}
+
+// Runs fn in a new transaction with the given isolation level and commits it.
+// If the commit fails with a conflict fn is run again in a fresh transaction,
+// up to maxRetries times, so fn must not have side effects outside the store.
+// An error returned by fn aborts the transaction and is returned as is.
+func (d *Database) RunTransaction(isolation IsolationLevel, maxRetries int, fn func(c *Connection) error) error {
+	c := d.newConnection()
+
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if _, err = c.execCommand("begin", []string{isolation.String()}); err != nil {
+			return err
+		}
+
+		if err = fn(c); err != nil {
+			if c.tx != nil {
+				c.execCommand("abort", nil)
+			}
+			return err
+		}
+
+		_, err = c.execCommand("commit", nil)
+		if !errors.Is(err, ErrWriteWriteConflict) && !errors.Is(err, ErrReadWriteConflict) {
+			return err
+		}
+
+		debug("retrying transaction after", err)
+	}
+
+	return err
+}
+
+// Reads commands from r, one per line with whitespace-separated arguments, and
+// writes the result of each to w. Any transaction still open when r is
+// exhausted is aborted.
+//
+// Values with whitespace or arbitrary bytes are set with "setraw <key> <len>"
+// followed by a newline and exactly len bytes, and read back with "getraw".
+func (c *Connection) repl(r io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			c.abortOpen()
+			return err
+		}
+
+		if fields := strings.Fields(line); len(fields) > 0 {
+			res, err := c.replCommand(reader, fields)
+			if err != nil {
+				fmt.Fprintf(w, "ERROR: %s\n", err)
+			} else {
+				fmt.Fprintln(w, res)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	c.abortOpen()
+	return nil
+}
+
+func (c *Connection) replCommand(reader *bufio.Reader, fields []string) (string, error) {
+	if fields[0] != "setraw" {
+		// A command that succeeded without finding its key, like getset on a
+		// missing one, prints NIL to tell it apart from an empty value.
+		res, err := c.ExecCommand(fields[0], fields[1:])
+		switch {
+		case err != nil:
+			return "", err
+		case res.Kind == ResultKindNotFound:
+			return "", ErrNoSuchKey
+		case !res.Found:
+			return "NIL", nil
+		}
+		return res.Value, nil
+	}
+
+	if len(fields) != 3 {
+		return "", ErrWrongArgs
+	}
+
+	n, err := strconv.Atoi(fields[2])
+	if err != nil || n < 0 {
+		return "", ErrNotInteger
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return "", err
+	}
+
+	return c.execCommand("setraw", []string{fields[1], string(payload)})
+}
+
+func (c *Connection) abortOpen() {
+	if c.tx != nil {
+		c.execCommand("abort", nil)
+	}
+}
+
+func main() {
+	db := newDatabase()
+	if DEBUG {
+		db.Logger = textLogger{w: os.Stdout}
+	}
+
+	if i := slices.Index(os.Args, "--listen"); i >= 0 && i+1 < len(os.Args) {
+		if err := db.ListenAndServe(os.Args[i+1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	c := db.newConnection()
+	if err := c.repl(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
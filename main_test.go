@@ -1,7 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestReadUncommitted(t *testing.T) {
@@ -29,11 +37,73 @@ func TestReadUncommitted(t *testing.T) {
 
 	res, err := c1.execCommand("get", []string{"x"})
 	assertEq(res, "", "c1 sees no x")
-	assertEq(err.Error(), errNoSuchKey, "c1 sees no x")
+	assert(errors.Is(err, ErrNoSuchKey), "c1 sees no x")
 
 	res, err = c2.execCommand("get", []string{"x"})
 	assertEq(res, "", "c2 sees no x")
-	assertEq(err.Error(), errNoSuchKey, "c2 sees no x")
+	assert(errors.Is(err, ErrNoSuchKey), "c2 sees no x")
+}
+
+func TestReadUncommitted_abort(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelReadUncommitted
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	c1.mustExecCommand("commit", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c2.mustExecCommand("set", []string{"x", "c2"})
+	c2.mustExecCommand("set", []string{"y", "c2"})
+
+	res := c3.mustExecCommand("get", []string{"x"})
+	assertEq(res, "c2", "c3 get x")
+
+	c2.mustExecCommand("abort", nil)
+
+	// The aborted writes are gone and the overwritten version is restored.
+	res = c3.mustExecCommand("get", []string{"x"})
+	assertEq(res, "c1", "c3 get x")
+
+	res, err := c3.execCommand("get", []string{"y"})
+	assertEq(res, "", "c3 get y")
+	assert(errors.Is(err, ErrNoSuchKey), "c3 get y")
+
+	assertEq(chainLength(db, "x"), 1, "x versions")
+	assertEq(chainLength(db, "y"), 0, "y versions")
+}
+
+func TestAbortKeepsConcurrentDeleteMarks(t *testing.T) {
+	db := newDatabase()
+
+	c0 := db.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "a"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	c2.mustExecCommand("delete", []string{"x"})
+
+	// Undoing c1's write must not clear the mark c2 put on the same version.
+	c1.mustExecCommand("abort", nil)
+	c2.mustExecCommand("commit", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+	res, err := c3.execCommand("get", []string{"x"})
+	assertEq(res, "", "c3 get x")
+	assert(errors.Is(err, ErrNoSuchKey), "c3 get x")
 }
 
 func TestReadCommitted(t *testing.T) {
@@ -56,7 +126,7 @@ func TestReadCommitted(t *testing.T) {
 	// committed.
 	res, err := c2.execCommand("get", []string{"x"})
 	assertEq(res, "", "c2 get x")
-	assertEq(err.Error(), errNoSuchKey, "c2 get x")
+	assert(errors.Is(err, ErrNoSuchKey), "c2 get x")
 
 	c1.mustExecCommand("commit", nil)
 
@@ -88,7 +158,7 @@ func TestReadCommitted(t *testing.T) {
 
 	res, err = c2.execCommand("get", []string{"x"})
 	assertEq(res, "", "c2 get x")
-	assertEq(err.Error(), errNoSuchKey, "c2 get x")
+	assert(errors.Is(err, ErrNoSuchKey), "c2 get x")
 
 	c2.mustExecCommand("commit", nil)
 
@@ -99,7 +169,7 @@ func TestReadCommitted(t *testing.T) {
 
 	res, err = c4.execCommand("get", []string{"x"})
 	assertEq(res, "", "c4 get x")
-	assertEq(err.Error(), errNoSuchKey, "c4 get x")
+	assert(errors.Is(err, ErrNoSuchKey), "c4 get x")
 }
 
 func TestRepeatableRead(t *testing.T) {
@@ -121,7 +191,7 @@ func TestRepeatableRead(t *testing.T) {
 	// committed.
 	res, err := c2.execCommand("get", []string{"x"})
 	assertEq(res, "", "c2 get x")
-	assertEq(err.Error(), errNoSuchKey, "c2 get x")
+	assert(errors.Is(err, ErrNoSuchKey), "c2 get x")
 
 	c1.mustExecCommand("commit", nil)
 
@@ -129,7 +199,7 @@ func TestRepeatableRead(t *testing.T) {
 	// transaction.
 	res, err = c2.execCommand("get", []string{"x"})
 	assertEq(res, "", "c2 get x")
-	assertEq(err.Error(), errNoSuchKey, "c2 get x")
+	assert(errors.Is(err, ErrNoSuchKey), "c2 get x")
 
 	// But is available in a new transaction.
 	c3 := db.newConnection()
@@ -146,7 +216,7 @@ func TestRepeatableRead(t *testing.T) {
 	// But not on the other commit, again.
 	res, err = c2.execCommand("get", []string{"x"})
 	assertEq(res, "", "c2 get x")
-	assertEq(err.Error(), errNoSuchKey, "c2 get x")
+	assert(errors.Is(err, ErrNoSuchKey), "c2 get x")
 
 	c3.mustExecCommand("abort", nil)
 
@@ -154,7 +224,7 @@ func TestRepeatableRead(t *testing.T) {
 	// transaction.
 	res, err = c2.execCommand("get", []string{"x"})
 	assertEq(res, "", "c2 get x")
-	assertEq(err.Error(), errNoSuchKey, "c2 get x")
+	assert(errors.Is(err, ErrNoSuchKey), "c2 get x")
 
 	// And again still the aborted set is still not on a new
 	// transaction.
@@ -174,7 +244,7 @@ func TestRepeatableRead(t *testing.T) {
 
 	res, err = c5.execCommand("get", []string{"x"})
 	assertEq(res, "", "c5 get x")
-	assertEq(err.Error(), errNoSuchKey, "c5 get x")
+	assert(errors.Is(err, ErrNoSuchKey), "c5 get x")
 }
 
 func TestSnapshotIsolation_writewrite_conflict(t *testing.T) {
@@ -197,37 +267,2829 @@ func TestSnapshotIsolation_writewrite_conflict(t *testing.T) {
 
 	res, err := c2.execCommand("commit", nil)
 	assertEq(res, "", "c2 commit")
-	assertEq(err.Error(), errWriteWriteConflict, "c2 commit")
+	assert(errors.Is(err, ErrWriteWriteConflict), "c2 commit")
 
 	// But unrelated keys cause no conflict.
 	c3.mustExecCommand("set", []string{"y", "no conflict"})
 	c3.mustExecCommand("commit", nil)
 }
 
-func TestSerializableIsolation_readwrite_conflict(t *testing.T) {
+func TestSnapshotIsolation_concurrent_writesets(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	c2.mustExecCommand("set", []string{"x", "c2"})
+	c3.mustExecCommand("set", []string{"x", "c3"})
+
+	// The stored transactions see the writesets of in-progress transactions.
+	assert(db.transaction(2).writeset.Contains("x"), "c2 writeset has x")
+
+	c1.mustExecCommand("commit", nil)
+
+	_, err := c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrWriteWriteConflict), "c2 commit")
+
+	_, err = c3.execCommand("commit", nil)
+	assert(errors.Is(err, ErrWriteWriteConflict), "c3 commit")
+}
+
+func TestSerializableIsolation_readonly(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", []string{"readonly"})
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	_, err := c1.execCommand("set", []string{"x", "c1"})
+	assert(errors.Is(err, ErrReadOnly), "c1 set x")
+
+	_, err = c1.execCommand("delete", []string{"x"})
+	assert(errors.Is(err, ErrReadOnly), "c1 delete x")
+
+	_, err = c1.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "c1 get x")
+
+	_, err = c2.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "c2 get x")
+
+	c3.mustExecCommand("set", []string{"x", "c3"})
+	c3.mustExecCommand("commit", nil)
+
+	// The read-only transaction commits while the read-write one aborts.
+	c1.mustExecCommand("commit", nil)
+
+	_, err = c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "c2 commit")
+}
+
+func TestBeginIsolation(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelReadCommitted
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", []string{"snapshot"})
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", []string{"serializable"})
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c4 := db.newConnection()
+	c4.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	c2.execCommand("get", []string{"y"})
+	c3.execCommand("get", []string{"y"})
+
+	c4.mustExecCommand("set", []string{"x", "c4"})
+	c4.mustExecCommand("set", []string{"y", "c4"})
+	c4.mustExecCommand("commit", nil)
+
+	_, err := c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrWriteWriteConflict), "c1 commit")
+
+	_, err = c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "c2 commit")
+
+	// The default read committed transaction doesn't detect conflicts.
+	c3.mustExecCommand("commit", nil)
+
+	_, err = c3.execCommand("begin", []string{"bogus"})
+	assert(errors.Is(err, ErrUnknownIsolation), "c3 begin bogus")
+	assert(c3.tx == nil, "no transaction started")
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	// A missing key matches the empty string.
+	res := c1.mustExecCommand("cas", []string{"x", "", "1"})
+	assertEq(res, "1", "c1 cas x")
+
+	res = c1.mustExecCommand("cas", []string{"x", "1", "2"})
+	assertEq(res, "2", "c1 cas x")
+
+	_, err := c1.execCommand("cas", []string{"x", "1", "3"})
+	assert(errors.Is(err, ErrCasMismatch), "c1 cas x")
+
+	res = c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "2", "c1 get x")
+	c1.mustExecCommand("commit", nil)
+
+	// The compared value is part of the readset.
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c2.mustExecCommand("cas", []string{"x", "2", "c2"})
+
+	c3.mustExecCommand("set", []string{"x", "c3"})
+	c3.mustExecCommand("commit", nil)
+
+	_, err = c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "c2 commit")
+}
+
+func TestIncr(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	res := c1.mustExecCommand("incr", []string{"x", "5"})
+	assertEq(res, "5", "c1 incr x")
+
+	res = c1.mustExecCommand("incr", []string{"x", "-7"})
+	assertEq(res, "-2", "c1 incr x")
+
+	c1.mustExecCommand("set", []string{"y", "hey"})
+	_, err := c1.execCommand("incr", []string{"y", "1"})
+	assert(errors.Is(err, ErrNotInteger), "c1 incr y")
+
+	_, err = c1.execCommand("incr", []string{"x", "one"})
+	assert(errors.Is(err, ErrNotInteger), "c1 incr x one")
+
+	// Overflowing leaves the value as it was.
+	c1.mustExecCommand("set", []string{"z", "9223372036854775807"})
+	_, err = c1.execCommand("incr", []string{"z", "1"})
+	assert(errors.Is(err, ErrOverflow), "c1 incr z")
+	assertEq(c1.mustExecCommand("get", []string{"z"}), "9223372036854775807", "c1 get z")
+	_, err = c1.execCommand("incr", []string{"x", "-9223372036854775807"})
+	assert(errors.Is(err, ErrOverflow), "c1 incr x below the minimum")
+	assertEq(c1.mustExecCommand("get", []string{"x"}), "-2", "c1 get x")
+	c1.mustExecCommand("commit", nil)
+
+	// Concurrent increments don't lose updates.
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c2.mustExecCommand("incr", []string{"x", "1"})
+	c3.mustExecCommand("incr", []string{"x", "1"})
+
+	c2.mustExecCommand("commit", nil)
+
+	_, err = c3.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "c3 commit")
+
+	c4 := db.newConnection()
+	c4.mustExecCommand("begin", nil)
+	res = c4.mustExecCommand("get", []string{"x"})
+	assertEq(res, "-1", "c4 get x")
+}
+
+func TestScan(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"user:2", "b"})
+	c1.mustExecCommand("set", []string{"user:1", "a"})
+	c1.mustExecCommand("set", []string{"user:3", "c"})
+	c1.mustExecCommand("set", []string{"order:1", "x"})
+	c1.mustExecCommand("commit", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c3.mustExecCommand("delete", []string{"user:3"})
+
+	// Uncommitted deletes are not visible.
+	res := c2.mustExecCommand("scan", []string{"user:"})
+	assertEq(res, "user:1=a\nuser:2=b\nuser:3=c", "c2 scan user:")
+
+	c3.mustExecCommand("commit", nil)
+
+	// The delete of a scanned key is a conflict.
+	_, err := c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "c2 commit")
+
+	c4 := db.newConnection()
+	c4.mustExecCommand("begin", nil)
+
+	res = c4.mustExecCommand("scan", []string{"user:"})
+	assertEq(res, "user:1=a\nuser:2=b", "c4 scan user:")
+
+	res = c4.mustExecCommand("scan", []string{"nope"})
+	assertEq(res, "", "c4 scan nope")
+}
+
+func TestSerializableIsolation_phantom(t *testing.T) {
 	db := newDatabase()
 	db.defaultIsolation = IsolationLevelSerializable
 
 	c1 := db.newConnection()
 	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"user:1", "a"})
+	c1.mustExecCommand("commit", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c4 := db.newConnection()
+	c4.mustExecCommand("begin", nil)
+
+	res := c2.mustExecCommand("scan", []string{"user:"})
+	assertEq(res, "user:1=a", "c2 scan user:")
+
+	res = c3.mustExecCommand("range", []string{"user:", "user:9"})
+	assertEq(res, "user:1=a", "c3 range user: user:9")
+
+	// Unrelated ranges don't conflict.
+	res = c4.mustExecCommand("scan", []string{"order:"})
+	assertEq(res, "", "c4 scan order:")
+
+	c5 := db.newConnection()
+	c5.mustExecCommand("begin", nil)
+	c5.mustExecCommand("set", []string{"user:5", "e"})
+	c5.mustExecCommand("commit", nil)
+
+	_, err := c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "c2 commit")
+
+	_, err = c3.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "c3 commit")
+
+	c4.mustExecCommand("commit", nil)
+}
+
+func TestRange(t *testing.T) {
+	db := newDatabase()
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	for _, key := range []string{"f", "e", "d", "c", "b", "a"} {
+		c1.mustExecCommand("set", []string{key, key + key})
+	}
+	c1.mustExecCommand("commit", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("delete", []string{"b"})
+	c2.mustExecCommand("delete", []string{"d"})
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	// The uncommitted deletes are only visible to the deleting transaction.
+	res := c2.mustExecCommand("range", []string{"a", "f"})
+	assertEq(res, "a=aa\nc=cc\ne=ee", "c2 range a f")
+
+	res = c3.mustExecCommand("range", []string{"a", "f"})
+	assertEq(res, "a=aa\nb=bb\nc=cc\nd=dd\ne=ee", "c3 range a f")
+
+	res = c3.mustExecCommand("range", []string{"b", "d"})
+	assertEq(res, "b=bb\nc=cc", "c3 range b d")
+}
+
+func TestKeys(t *testing.T) {
+	db := newDatabase()
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"z", "1"})
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("set", []string{"y", "1"})
+	c1.mustExecCommand("commit", nil)
 
 	c2 := db.newConnection()
 	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("delete", []string{"y"})
+	c2.mustExecCommand("commit", nil)
 
+	// Keys only written by an uncommitted transaction are not listed.
 	c3 := db.newConnection()
 	c3.mustExecCommand("begin", nil)
+	c3.mustExecCommand("set", []string{"w", "1"})
+
+	c4 := db.newConnection()
+	c4.mustExecCommand("begin", nil)
 
+	res := c4.mustExecCommand("keys", nil)
+	assertEq(res, "x\nz", "c4 keys")
+
+	res = c3.mustExecCommand("keys", nil)
+	assertEq(res, "w\nx\nz", "c3 keys")
+}
+
+func TestExists(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
 	c1.mustExecCommand("set", []string{"x", "hey"})
 	c1.mustExecCommand("commit", nil)
 
-	_, err := c2.execCommand("get", []string{"x"})
-	assertEq(err.Error(), errNoSuchKey, "c5 get x")
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
 
-	res, err := c2.execCommand("commit", nil)
-	assertEq(res, "", "c2 commit")
-	assertEq(err.Error(), errReadWriteConflict, "c2 commit")
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
 
-	// But unrelated keys cause no conflict.
-	c3.mustExecCommand("set", []string{"y", "no conflict"})
+	res := c2.mustExecCommand("exists", []string{"x"})
+	assertEq(res, "1", "c2 exists x")
+
+	res = c2.mustExecCommand("exists", []string{"y"})
+	assertEq(res, "0", "c2 exists y")
+
+	// An existence check is a read.
+	c3.mustExecCommand("set", []string{"y", "hey"})
 	c3.mustExecCommand("commit", nil)
+
+	_, err := c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "c2 commit")
+}
+
+func TestRunTransaction(t *testing.T) {
+	db := newDatabase()
+
+	incr := func(c *Connection) error {
+		_, err := c.execCommand("incr", []string{"x", "1"})
+		return err
+	}
+
+	// The first call is interleaved with the second, which commits in between
+	// its read and its commit.
+	attempts1, attempts2 := 0, 0
+	err := db.RunTransaction(IsolationLevelSnapshot, 1, func(c *Connection) error {
+		attempts1 += 1
+		if attempts1 == 1 {
+			err := db.RunTransaction(IsolationLevelSnapshot, 1, func(c *Connection) error {
+				attempts2 += 1
+				return incr(c)
+			})
+			assertEq(err, nil, "second run")
+		}
+
+		return incr(c)
+	})
+	assertEq(err, nil, "first run")
+	assertEq(attempts1, 2, "first attempts")
+	assertEq(attempts2, 1, "second attempts")
+
+	// Both increments went through.
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	res := c.mustExecCommand("get", []string{"x"})
+	assertEq(res, "2", "get x")
+	c.mustExecCommand("commit", nil)
+
+	// Without retries the conflict is returned.
+	err = db.RunTransaction(IsolationLevelSnapshot, 0, func(c *Connection) error {
+		db.RunTransaction(IsolationLevelSnapshot, 0, incr)
+		return incr(c)
+	})
+	assert(errors.Is(err, ErrWriteWriteConflict), "conflict")
+
+	// Errors from fn abort without retrying.
+	err = db.RunTransaction(IsolationLevelSnapshot, 3, func(c *Connection) error {
+		c.mustExecCommand("set", []string{"x", "nope"})
+		return ErrCasMismatch
+	})
+	assert(errors.Is(err, ErrCasMismatch), "fn error")
+
+	c.mustExecCommand("begin", nil)
+	res = c.mustExecCommand("get", []string{"x"})
+	assertEq(res, "3", "get x")
+}
+
+func TestGetAs(t *testing.T) {
+	db := newDatabase()
+
+	c := db.newConnection()
+	for _, value := range []string{"1", "2", "3"} {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", value})
+		c.mustExecCommand("commit", nil)
+	}
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("delete", []string{"x"})
+	c.mustExecCommand("commit", nil)
+
+	for id, value := range []string{"1", "2", "3"} {
+		res := c.mustExecCommand("getas", []string{fmt.Sprintf("%d", id+1), "x"})
+		assertEq(res, value, "getas x")
+	}
+
+	_, err := c.execCommand("getas", []string{"4", "x"})
+	assert(errors.Is(err, ErrNoSuchKey), "getas 4 x")
+
+	_, err = c.execCommand("getas", []string{"5", "x"})
+	assert(errors.Is(err, ErrNoSuchTransaction), "getas 5 x")
+}
+
+func TestHistory(t *testing.T) {
+	db := newDatabase()
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "a"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "b"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("delete", []string{"x"})
+	c1.mustExecCommand("commit", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "c"})
+
+	res := c2.mustExecCommand("history", []string{"x"})
+	assertEq(res, "start=1 end=2 state=committed value=a\n"+
+		"start=2 end=3 state=committed value=b\n"+
+		"start=4 end=0 state=inprogress value=c", "history x")
+
+	res = c2.mustExecCommand("history", []string{"y"})
+	assertEq(res, "", "history y")
+}
+
+func TestLock(t *testing.T) {
+	conflicts := map[IsolationLevel]error{
+		IsolationLevelSnapshot:     ErrWriteWriteConflict,
+		IsolationLevelSerializable: ErrReadWriteConflict,
+	}
+
+	for isolation, conflict := range conflicts {
+		db := newDatabase()
+		db.defaultIsolation = isolation
+
+		c1 := db.newConnection()
+		c1.mustExecCommand("begin", nil)
+
+		c2 := db.newConnection()
+		c2.mustExecCommand("begin", nil)
+
+		c1.mustExecCommand("lock", []string{"x"})
+		c2.mustExecCommand("lock", []string{"x"})
+
+		c1.mustExecCommand("commit", nil)
+
+		_, err := c2.execCommand("commit", nil)
+		assert(errors.Is(err, conflict), "c2 commit")
+
+		// Locking doesn't create a version.
+		assertEq(chainLength(db, "x"), 0, "x versions")
+	}
+}
+
+func TestMultiGetSet(t *testing.T) {
+	db := newDatabase()
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	_, err := c1.execCommand("mset", []string{"x", "1", "y"})
+	assert(errors.Is(err, ErrWrongArgs), "c1 mset odd args")
+	assertEq(chainLength(db, "x"), 0, "x versions")
+
+	c1.mustExecCommand("mset", []string{"x", "1", "y", "2", "z", "3"})
+
+	res := c1.mustExecCommand("mget", []string{"x", "y", "w", "z"})
+	assertEq(res, "1\n2\n\n3", "c1 mget")
+
+	// None of the keys are visible before commit.
+	res = c2.mustExecCommand("mget", []string{"x", "y", "z"})
+	assertEq(res, "\n\n", "c2 mget")
+
+	c1.mustExecCommand("commit", nil)
+
+	res = c2.mustExecCommand("mget", []string{"x", "y", "z"})
+	assertEq(res, "1\n2\n3", "c2 mget")
+}
+
+func TestSetExpiring(t *testing.T) {
+	db := newDatabase()
+	now := time.Unix(1000, 0)
+	db.now = func() time.Time { return now }
+
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("setex", []string{"x", "hey", "10"})
+	c.mustExecCommand("set", []string{"y", "hey"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+
+	now = now.Add(9 * time.Second)
+	res := c.mustExecCommand("get", []string{"x"})
+	assertEq(res, "hey", "get x")
+
+	now = now.Add(time.Second)
+	_, err := c.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "get x")
+
+	res = c.mustExecCommand("get", []string{"x", "status"})
+	assertEq(res, "deleted", "get x status")
+
+	res = c.mustExecCommand("get", []string{"y"})
+	assertEq(res, "hey", "get y")
+
+	_, err = c.execCommand("setex", []string{"x", "hey", "soon"})
+	assert(errors.Is(err, ErrNotInteger), "setex x")
+}
+
+func TestReapExpired(t *testing.T) {
+	db := newDatabase()
+	db.TxTimeout = 10 * time.Second
+	now := time.Unix(1000, 0)
+	db.now = func() time.Time { return now }
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "c1"})
+
+	now = now.Add(8 * time.Second)
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	assertEq(db.ReapExpired(), 0, "reaped")
+
+	now = now.Add(3 * time.Second)
+	assertEq(db.ReapExpired(), 1, "reaped")
+	assertEq(db.transaction(1).state, TransactionStateAborted, "c1 aborted")
+
+	// The reaped connection fails gracefully and can start over.
+	_, err := c1.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrTimedOut), "c1 get x")
+
+	c1.mustExecCommand("begin", nil)
+	_, err = c1.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "c1 get x")
+
+	c2.mustExecCommand("set", []string{"x", "c2"})
+	c2.mustExecCommand("commit", nil)
+}
+
+func TestExecCommandResult(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	res, err := c.ExecCommand("begin", nil)
+	assertEq(err, nil, "begin")
+	assertEq(res, Result{Value: "1", Found: true, Kind: ResultKindTxId}, "begin")
+
+	c.mustExecCommand("set", []string{"x", ""})
+
+	// An empty value is found while a missing key isn't.
+	res, err = c.ExecCommand("get", []string{"x"})
+	assertEq(err, nil, "get x")
+	assertEq(res, Result{Value: "", Found: true, Kind: ResultKindOk}, "get x")
+
+	res, err = c.ExecCommand("get", []string{"y"})
+	assertEq(err, nil, "get y")
+	assertEq(res, Result{Value: "", Found: false, Kind: ResultKindNotFound}, "get y")
+
+	_, err = c.ExecCommand("rollback", []string{"nope"})
+	assert(errors.Is(err, ErrNoSuchSavepoint), "rollback nope")
+}
+
+func TestStats(t *testing.T) {
+	db := newDatabase()
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", []string{"snapshot"})
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", []string{"snapshot"})
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", []string{"serializable"})
+
+	c4 := db.newConnection()
+	c4.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	c2.mustExecCommand("set", []string{"x", "c2"})
+	c3.execCommand("get", []string{"x"})
+
+	assertEq(db.Stats(), Stats{Started: 4, InProgress: 4}, "stats")
+
+	c1.mustExecCommand("commit", nil)
+	c2.execCommand("commit", nil)
+	c3.execCommand("commit", nil)
+	c4.mustExecCommand("abort", nil)
+
+	assertEq(db.Stats(), Stats{
+		Started:             4,
+		Committed:           1,
+		Aborted:             1,
+		WriteWriteConflicts: 1,
+		ReadWriteConflicts:  1,
+	}, "stats")
+}
+
+func TestOnCommit(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+
+	commits := []string{}
+	db.OnCommit(func(txId uint64, writeset []string) {
+		commits = append(commits, fmt.Sprintf("%d: %s", txId, strings.Join(writeset, " ")))
+	})
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"y", "c1"})
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	c1.mustExecCommand("commit", nil)
+
+	// Neither aborts nor conflicts run the callbacks.
+	c2.mustExecCommand("set", []string{"x", "c2"})
+	c2.execCommand("commit", nil)
+
+	c3.mustExecCommand("set", []string{"z", "c3"})
+	c3.mustExecCommand("abort", nil)
+
+	assertEq(strings.Join(commits, "\n"), "1: x y", "commits")
+}
+
+func TestTransactionMisuse(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	for _, command := range []string{"get", "set", "delete", "commit", "abort"} {
+		_, err := c.execCommand(command, []string{"x", "1"})
+		assert(errors.Is(err, ErrNoTransaction), command+" without transaction")
+	}
+
+	c.mustExecCommand("begin", nil)
+	_, err := c.execCommand("begin", nil)
+	assert(errors.Is(err, ErrTransactionInProgress), "double begin")
+
+	// The open transaction is left untouched.
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+}
+
+func TestAutocommit(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+	db.FirstUpdaterWins = true
+
+	c1 := db.newConnection()
+	c1.Autocommit = true
+	c2 := db.newConnection()
+	c2.Autocommit = true
+
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	c2.mustExecCommand("set", []string{"x", "c2"})
+	assertEq(c1.mustExecCommand("get", []string{"x"}), "c2", "c1 get x")
+	_, err := c1.execCommand("get", []string{"y"})
+	assert(errors.Is(err, ErrNoSuchKey), "c1 get y")
+	_, err = c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrNoTransaction), "c1 commit")
+
+	// Autocommitted statements run back to back, so a conflict needs an
+	// explicit transaction holding the key.
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+	c3.mustExecCommand("set", []string{"x", "c3"})
+
+	_, err = c2.execCommand("set", []string{"x", "c2 again"})
+	assert(errors.Is(err, ErrWriteWriteConflict), "c2 set x")
+	assertEq(c2.tx, (*Transaction)(nil), "c2 has no transaction")
+
+	c3.mustExecCommand("commit", nil)
+	assertEq(c1.mustExecCommand("get", []string{"x"}), "c3", "c1 get x")
+
+	// Without autocommit the connection still requires begin.
+	c4 := db.newConnection()
+	_, err = c4.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoTransaction), "c4 get x")
+}
+
+func TestSetIsolation(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+
+	_, err := c2.execCommand("set_isolation", []string{"bogus"})
+	assert(errors.Is(err, ErrUnknownIsolation), "set_isolation bogus")
+	c2.mustExecCommand("set_isolation", []string{"serializable"})
+	assertEq(c1.tx.isolation, IsolationLevelReadCommitted, "c1 isolation")
+
+	c2.mustExecCommand("begin", nil)
+	assertEq(c2.tx.isolation, IsolationLevelSerializable, "c2 isolation")
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	_, err = c2.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "c2 get x")
+	c2.mustExecCommand("set", []string{"y", "c2"})
+	c3.mustExecCommand("set", []string{"x", "c3"})
+	c3.mustExecCommand("commit", nil)
+
+	_, err = c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "c2 commit")
+	c1.mustExecCommand("commit", nil)
+
+	db.SetDefaultIsolation(IsolationLevelSnapshot)
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.tx.isolation, IsolationLevelSnapshot, "c1 isolation")
+}
+
+func TestTransactionIdExhaustion(t *testing.T) {
+	db := newDatabase()
+	db.nextTransactionId = math.MaxUint64 - 1
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "c1"})
+
+	c2 := db.newConnection()
+	_, err := c2.execCommand("begin", nil)
+	assert(errors.Is(err, ErrIdsExhausted), "c2 begin")
+
+	err = db.ResetTransactionIds()
+	assert(errors.Is(err, ErrActiveTransactions), "reset with c1 in progress")
+
+	c1.mustExecCommand("commit", nil)
+	err = db.ResetTransactionIds()
+	assert(errors.Is(err, ErrStoreNotEmpty), "reset with x stored")
+
+	db = newDatabase()
+	db.nextTransactionId = math.MaxUint64 - 1
+	c1 = db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("commit", nil)
+
+	assertEq(db.ResetTransactionIds(), nil, "reset")
+	assertEq(c1.mustExecCommand("begin", nil), "1", "c1 begin")
+}
+
+func TestCommitOrder(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelRepeatableRead
+
+	setup := db.newConnection()
+	setup.mustExecCommand("begin", nil)
+	setup.mustExecCommand("set", []string{"y", "setup"})
+	setup.mustExecCommand("commit", nil)
+
+	// The older transaction commits after the younger one started.
+	older := db.newConnection()
+	older.mustExecCommand("begin", nil)
+	older.mustExecCommand("set", []string{"x", "older"})
+	older.mustExecCommand("delete", []string{"y"})
+
+	younger := db.newConnection()
+	younger.mustExecCommand("begin", nil)
+	older.mustExecCommand("commit", nil)
+
+	_, err := younger.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "younger get x")
+	res := younger.mustExecCommand("get", []string{"y"})
+	assertEq(res, "setup", "younger get y")
+	younger.mustExecCommand("commit", nil)
+
+	assert(db.transaction(2).commitId > db.transaction(3).snapshot, "older committed after younger started")
+
+	latest := db.newConnection()
+	latest.mustExecCommand("begin", nil)
+	res = latest.mustExecCommand("get", []string{"x"})
+	assertEq(res, "older", "latest get x")
+	_, err = latest.execCommand("get", []string{"y"})
+	assert(errors.Is(err, ErrNoSuchKey), "latest get y")
+}
+
+func TestCount(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("set", []string{"y", "1"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("delete", []string{"y"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("count", nil), "1", "c1 count")
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"z", "1"})
+	c2.mustExecCommand("commit", nil)
+
+	// The insert is a phantom for c1, which conflicts once it writes.
+	assertEq(c1.mustExecCommand("count", nil), "1", "c1 count")
+	c1.mustExecCommand("set", []string{"total", "1"})
+	_, err := c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "c1 commit")
+
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("count", nil), "2", "c1 count")
+}
+
+func TestGetSet(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "old"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	res, err := c.ExecCommand("getset", []string{"x", "new"})
+	assertEq(err, nil, "getset x")
+	assertEq(res, Result{Value: "old", Found: true, Kind: ResultKindOk}, "getset x")
+
+	res, err = c.ExecCommand("getset", []string{"y", "new"})
+	assertEq(err, nil, "getset y")
+	assertEq(res, Result{Kind: ResultKindOk, Found: false}, "getset y")
+	res, err = c.ExecCommand("getset", []string{"empty", ""})
+	assertEq(err, nil, "getset empty")
+	res, err = c.ExecCommand("getset", []string{"empty", "new"})
+	assertEq(err, nil, "getset empty")
+	assertEq(res, Result{Kind: ResultKindOk, Found: true}, "getset empty")
+	assertEq(c.mustExecCommand("getset", []string{"z", "new"}), "", "getset z")
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("get", []string{"x"}), "new", "get x")
+	assertEq(c.mustExecCommand("get", []string{"y"}), "new", "get y")
+	assertEq(c.mustExecCommand("get", []string{"z"}), "new", "get z")
+}
+
+func TestDelIf(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"lock", "owner1"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	_, err := c.execCommand("delif", []string{"lock", "owner2"})
+	assert(errors.Is(err, ErrConditionFailed), "delif lock owner2")
+	assertEq(c.mustExecCommand("get", []string{"lock"}), "owner1", "get lock")
+	assert(!c.tx.writeset.Contains("lock"), "lock not written")
+
+	c.mustExecCommand("delif", []string{"lock", "owner1"})
+	_, err = c.execCommand("get", []string{"lock"})
+	assert(errors.Is(err, ErrNoSuchKey), "get lock")
+
+	_, err = c.execCommand("delif", []string{"lock", "owner1"})
+	assert(errors.Is(err, ErrNoSuchKey), "delif deleted lock")
+	c.mustExecCommand("commit", nil)
+}
+
+func TestExecScript(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	results, err := c.ExecScript("begin; set x 1; set y 2; commit")
+	assertEq(err, nil, "explicit script")
+	assertEq(len(results), 4, "explicit script results")
+	assertEq(results[0].Kind, ResultKindTxId, "begin result")
+
+	// Without begin the script runs in an implicit transaction.
+	results, err = c.ExecScript("get x; get z; set z 3")
+	assertEq(err, nil, "implicit script")
+	assertEq(results[0].Value, "1", "get x")
+	assertEq(results[1].Kind, ResultKindNotFound, "get z")
+	assertEq(c.tx, (*Transaction)(nil), "implicit transaction committed")
+
+	// An error stops the script and aborts the implicit transaction.
+	results, err = c.ExecScript("set w 4; cas x 9 10; set v 5")
+	assert(errors.Is(err, ErrCasMismatch), "failing script")
+	assertEq(len(results), 1, "failing script results")
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("mget", []string{"x", "y", "z"}), "1\n2\n3", "mget x y z")
+	_, err = c.execCommand("get", []string{"w"})
+	assert(errors.Is(err, ErrNoSuchKey), "get w")
+}
+
+func TestDeadlockDetection(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("lock", []string{"a", "wait"})
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("lock", []string{"b", "wait"})
+
+	done := make(chan error)
+	go func() {
+		_, err := c1.execCommand("lock", []string{"b", "wait"})
+		done <- err
+	}()
+
+	for waiting := false; !waiting; {
+		db.mu.Lock()
+		_, waiting = db.waitsFor[1]
+		db.mu.Unlock()
+	}
+
+	// c2 closes the cycle and, being the youngest, is aborted.
+	_, err := c2.execCommand("lock", []string{"a", "wait"})
+	assert(errors.Is(err, ErrDeadlock), "c2 lock a")
+	assertEq(db.transaction(2).state, TransactionStateAborted, "c2 aborted")
+
+	assertEq(<-done, nil, "c1 lock b")
+	c1.mustExecCommand("set", []string{"a", "c1"})
+	c1.mustExecCommand("commit", nil)
+
+	// The locks are released once the transaction ends.
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("lock", []string{"a", "wait"})
+	c2.mustExecCommand("lock", []string{"b", "wait"})
+	c2.mustExecCommand("commit", nil)
+}
+
+func TestPrecommit(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	assertEq(c1.mustExecCommand("precommit", nil), "ok", "c1 precommit")
+
+	c2.mustExecCommand("set", []string{"x", "c2"})
+	c2.mustExecCommand("commit", nil)
+
+	assertEq(c1.mustExecCommand("precommit", nil), "write-write", "c1 precommit")
+	assertEq(db.transaction(1).state, TransactionStateInProgress, "c1 in progress")
+	assertEq(c1.mustExecCommand("get", []string{"x"}), "c1", "c1 get x")
+
+	_, err := c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrWriteWriteConflict), "c1 commit")
+	assertEq(db.Stats().WriteWriteConflicts, uint64(1), "write-write conflicts")
+}
+
+func TestMaxVersionsPerKey(t *testing.T) {
+	db := newDatabase()
+	db.MaxVersionsPerKey = 4
+
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "0"})
+	c.mustExecCommand("commit", nil)
+
+	reader := db.newConnection()
+	reader.mustExecCommand("begin", []string{"repeatable_read"})
+
+	for i := 1; i <= 100; i++ {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", fmt.Sprintf("%d", i)})
+		c.mustExecCommand("commit", nil)
+		assert(chainLength(db, "x") <= 4, "x chain bounded")
+	}
+
+	// The version the reader sees is never evicted.
+	assertEq(reader.mustExecCommand("get", []string{"x"}), "0", "reader get x")
+	reader.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("get", []string{"x"}), "100", "get x")
+}
+
+func TestEvictedHistory(t *testing.T) {
+	db := newDatabase()
+	db.MaxVersionsPerKey = 2
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	db.now = func() time.Time { return now }
+
+	c := db.newConnection()
+	for i := 1; i <= 3; i++ {
+		now = now.Add(time.Minute)
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", fmt.Sprint(i)})
+		c.mustExecCommand("commit", nil)
+	}
+
+	// The first version was evicted to make room for the third.
+	_, err := c.execCommand("getas", []string{"1", "x"})
+	assert(errors.Is(err, ErrHistoryUnavailable), "getas 1 x")
+	_, err = c.execCommand("getastime", []string{"2024-01-01T12:01:00Z", "x"})
+	assert(errors.Is(err, ErrHistoryUnavailable), "x at the first commit")
+	assertEq(c.mustExecCommand("getas", []string{"3", "x"}), "3", "getas 3 x")
+	assertEq(c.mustExecCommand("getastime", []string{"2024-01-01T12:02:00Z", "x"}), "2", "x at the second commit")
+
+	// Evicting a whole key loses its history up to then.
+	db.MaxKeys = 1
+	now = now.Add(time.Minute)
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"y", "1"})
+	c.mustExecCommand("commit", nil)
+	_, err = c.execCommand("getastime", []string{"2024-01-01T12:03:00Z", "x"})
+	assert(errors.Is(err, ErrHistoryUnavailable), "x after eviction")
+	_, err = c.execCommand("getastime", []string{"2024-01-01T12:03:00Z", "y"})
+	assert(errors.Is(err, ErrNoSuchKey), "y before its write")
+}
+
+func TestVersions(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+
+	c1 := db.newConnection()
+	for i := 1; i <= 4; i++ {
+		c1.mustExecCommand("begin", nil)
+		c1.mustExecCommand("set", []string{"x", fmt.Sprintf("%d", i)})
+		c1.mustExecCommand("commit", nil)
+	}
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	// Written after c2 started, so invisible to it.
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "5"})
+	c1.mustExecCommand("commit", nil)
+
+	assertEq(c2.mustExecCommand("versions", []string{"x", "2"}), "4\n3", "c2 versions x 2")
+	assertEq(c2.mustExecCommand("versions", []string{"x", "10"}), "4\n3\n2\n1", "c2 versions x 10")
+	assertEq(c2.mustExecCommand("versions", []string{"y", "10"}), "", "c2 versions y 10")
+
+	_, err := c2.execCommand("versions", []string{"x", "0"})
+	assert(errors.Is(err, ErrNotPositive), "c2 versions x 0")
+}
+
+func TestAbortTransaction(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "c1"})
+
+	assert(errors.Is(db.AbortTransaction(1), nil), "abort c1")
+	assert(errors.Is(db.AbortTransaction(1), ErrTransactionFinished), "abort c1 again")
+	assert(errors.Is(db.AbortTransaction(7), ErrNoSuchTransaction), "abort unknown")
+
+	_, err := c1.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrAbortedExternally), "c1 get x")
+
+	c1.mustExecCommand("begin", nil)
+	_, err = c1.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "c1 get x")
+
+	admin := db.newConnection()
+	admin.mustExecCommand("kill", []string{"2"})
+	_, err = c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrAbortedExternally), "c1 commit")
+}
+
+func TestWriteSkew(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+
+	setup := db.newConnection()
+	setup.mustExecCommand("begin", nil)
+	setup.mustExecCommand("set", []string{"alice", "oncall"})
+	setup.mustExecCommand("set", []string{"bob", "oncall"})
+	setup.mustExecCommand("commit", nil)
+
+	// Each doctor goes off call after checking that the other is on call, so
+	// at least one of them must remain on call.
+	goOffCall := func(c *Connection, self string, other string) {
+		c.mustExecCommand("begin", nil)
+		assertEq(c.mustExecCommand("get", []string{other}), "oncall", self+" get "+other)
+		c.mustExecCommand("get", []string{self})
+		c.mustExecCommand("set", []string{self, "offcall"})
+	}
+
+	alice := db.newConnection()
+	bob := db.newConnection()
+	goOffCall(alice, "alice", "bob")
+	goOffCall(bob, "bob", "alice")
+
+	alice.mustExecCommand("commit", nil)
+	_, err := bob.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "bob commit")
+
+	setup.mustExecCommand("begin", nil)
+	assertEq(setup.mustExecCommand("mget", []string{"alice", "bob"}), "offcall\noncall", "mget alice bob")
+}
+
+func TestMinIsolation(t *testing.T) {
+	db := newDatabase()
+	db.MinIsolation = IsolationLevelReadCommitted
+
+	c := db.newConnection()
+	_, err := c.execCommand("begin", []string{"read_uncommitted"})
+	assert(errors.Is(err, ErrIsolationTooWeak), "begin read_uncommitted")
+	assertEq(c.tx, (*Transaction)(nil), "no transaction")
+
+	c.mustExecCommand("begin", []string{"serializable"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("set_isolation", []string{"read_uncommitted"})
+	_, err = c.execCommand("begin", nil)
+	assert(errors.Is(err, ErrIsolationTooWeak), "begin at default")
+}
+
+func TestFlushAll(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "c1"})
+
+	c2 := db.newConnection()
+	_, err := c2.execCommand("flushall", nil)
+	assert(errors.Is(err, ErrActiveTransactions), "flushall with c1 in progress")
+	assertEq(err.Error(), "cannot flush with active transactions", "flushall error")
+
+	c1.mustExecCommand("commit", nil)
+	c2.mustExecCommand("flushall", nil)
+	assertEq(len(db.store), 0, "stored keys")
+
+	assertEq(c2.mustExecCommand("begin", nil), "1", "c2 begin")
+	_, err = c2.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "c2 get x")
+}
+
+func TestMaxWritesPerTx(t *testing.T) {
+	db := newDatabase()
+	db.MaxWritesPerTx = 3
+
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"a", "1"})
+	c.mustExecCommand("set", []string{"b", "1"})
+	c.mustExecCommand("set", []string{"c", "1"})
+	c.mustExecCommand("set", []string{"a", "2"})
+
+	_, err := c.execCommand("set", []string{"d", "1"})
+	assert(errors.Is(err, ErrWriteLimit), "set d")
+	_, err = c.execCommand("delete", []string{"e"})
+	assert(errors.Is(err, ErrWriteLimit), "delete e")
+
+	assertEq(db.transaction(1).state, TransactionStateInProgress, "still in progress")
+	c.mustExecCommand("abort", nil)
+}
+
+func TestMaxWritesPerTxMultiKey(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("mset", []string{"p:1", "1", "p:2", "2", "p:3", "3", "src", "s"})
+	c.mustExecCommand("commit", nil)
+
+	db.MaxWritesPerTx = 2
+
+	// Each command is checked as a whole, writing nothing when over the limit.
+	c.mustExecCommand("begin", nil)
+	_, err := c.execCommand("mset", []string{"a", "1", "b", "2", "c", "3", "d", "4"})
+	assert(errors.Is(err, ErrWriteLimit), "mset")
+	c.mustExecCommand("set", []string{"a", "1"})
+	_, err = c.execCommand("transfer", []string{"x", "y", "1"})
+	assert(errors.Is(err, ErrWriteLimit), "transfer")
+	_, err = c.execCommand("rename", []string{"src", "dst"})
+	assert(errors.Is(err, ErrWriteLimit), "rename")
+	_, err = c.execCommand("delprefix", []string{"p:"})
+	assert(errors.Is(err, ErrWriteLimit), "delprefix")
+	assertEq(c.mustExecCommand("dirty", nil), "a", "written keys")
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("scan", []string{"p:"}), "p:1=1\np:2=2\np:3=3", "p keys")
+	assertEq(c.mustExecCommand("get", []string{"src"}), "s", "src")
+}
+
+func TestSnapshotRead(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("mset", []string{"x", "1", "y", "1"})
+	c2.mustExecCommand("commit", nil)
+
+	// Separate reads under read committed may straddle a commit.
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("get", []string{"x"}), "1", "c1 get x")
+
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("mset", []string{"x", "2", "y", "2"})
+	c2.mustExecCommand("commit", nil)
+
+	assertEq(c1.mustExecCommand("get", []string{"y"}), "2", "c1 get y")
+	assertEq(c1.mustExecCommand("snapshot", []string{"x", "y", "z"}), "x=2\ny=2", "c1 snapshot x y z")
+	assert(c1.tx.readset.Contains("z"), "z in readset")
+}
+
+func TestCursor(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("mset", []string{"a", "1", "b", "1", "c", "1"})
+	c2.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	cursor, err := c1.Cursor()
+	assertEq(err, nil, "c1 cursor")
+
+	assert(cursor.Next(), "first key")
+	assertEq(cursor.Key()+"="+cursor.Value(), "a=1", "first pair")
+
+	// The new key was stored after the cursor was created so it never shows
+	// up, while the updated key is read at its latest committed value under
+	// read committed.
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("mset", []string{"ab", "2", "b", "2"})
+	c2.mustExecCommand("delete", []string{"c"})
+	c2.mustExecCommand("commit", nil)
+
+	assert(cursor.Next(), "second key")
+	assertEq(cursor.Key()+"="+cursor.Value(), "b=2", "second pair")
+	assert(!cursor.Next(), "no more keys")
+
+	c3 := db.newConnection()
+	_, err = c3.Cursor()
+	assert(errors.Is(err, ErrNoTransaction), "c3 cursor")
+}
+
+func TestConflictPolicy(t *testing.T) {
+	db := newDatabase()
+	counts := map[string]int{}
+	db.ConflictPolicy = func(t *Transaction, kind string) Decision {
+		counts[kind] += 1
+		if kind == "read-write" {
+			return DecisionRetry
+		}
+		return DecisionAbort
+	}
+
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+	for i := 0; i < 5; i++ {
+		c1.mustExecCommand("begin", []string{"snapshot"})
+		c2.mustExecCommand("begin", []string{"snapshot"})
+		c1.mustExecCommand("set", []string{"x", "c1"})
+		c2.mustExecCommand("set", []string{"x", "c2"})
+		c1.mustExecCommand("commit", nil)
+		_, err := c2.execCommand("commit", nil)
+		assert(errors.Is(err, ErrWriteWriteConflict), "c2 commit")
+		assert(!errors.Is(err, ErrRetry), "c2 commit not retried")
+	}
+
+	for i := 0; i < 3; i++ {
+		c1.mustExecCommand("begin", []string{"serializable"})
+		c2.mustExecCommand("begin", []string{"serializable"})
+		c1.mustExecCommand("get", []string{"x"})
+		c1.mustExecCommand("set", []string{"y", "c1"})
+		c2.mustExecCommand("set", []string{"x", "c2"})
+		c2.mustExecCommand("commit", nil)
+		_, err := c1.execCommand("commit", nil)
+		assert(errors.Is(err, ErrReadWriteConflict), "c1 commit")
+		assert(errors.Is(err, ErrRetry), "c1 commit retried")
+	}
+
+	// User aborts are not conflicts.
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("abort", nil)
+
+	assertEq(counts["write-write"], 5, "write-write conflicts")
+	assertEq(counts["read-write"], 3, "read-write conflicts")
+}
+
+func TestTouch(t *testing.T) {
+	db := newDatabase()
+	now := time.Unix(1000, 0)
+	db.now = func() time.Time { return now }
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("setex", []string{"lease", "owner", "10"})
+	c1.mustExecCommand("commit", nil)
+
+	reader := db.newConnection()
+	reader.mustExecCommand("begin", []string{"snapshot"})
+
+	now = now.Add(8 * time.Second)
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("touch", []string{"lease", "10"}), "owner", "touch lease")
+	c1.mustExecCommand("commit", nil)
+
+	now = now.Add(8 * time.Second)
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("get", []string{"lease"}), "owner", "get lease")
+
+	// The snapshot taken before the touch still sees the original expiry.
+	_, err := reader.execCommand("get", []string{"lease"})
+	assert(errors.Is(err, ErrNoSuchKey), "reader get lease")
+
+	now = now.Add(8 * time.Second)
+	_, err = c1.execCommand("touch", []string{"lease", "10"})
+	assert(errors.Is(err, ErrNoSuchKey), "touch expired lease")
+}
+
+func TestStatus(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	assertEq(c.mustExecCommand("status", nil), "no transaction", "status")
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("status", nil), "id=1 isolation=read_committed state=inprogress", "status")
+	assertEq(c.tx.readset.Len(), 0, "readset size")
+
+	c.mustExecCommand("commit", nil)
+	c.mustExecCommand("begin", []string{"serializable", "readonly"})
+	assertEq(c.mustExecCommand("status", nil), "id=2 isolation=serializable state=inprogress", "status")
+}
+
+func TestVersionStamps(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("setv", []string{"x", "a", "0"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("getv", []string{"x"}), "a@1", "c1 getv x")
+
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "b"})
+	c2.mustExecCommand("commit", nil)
+
+	_, err := c1.execCommand("setv", []string{"x", "c", "1"})
+	assert(errors.Is(err, ErrStaleVersion), "c1 setv x")
+	c1.mustExecCommand("setv", []string{"x", "c", "3"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("getv", []string{"x"}), "c@2", "c1 getv x")
+}
+
+func TestBackgroundVacuum(t *testing.T) {
+	db := newDatabase()
+	overwriteCommitted(db, "x", 100)
+
+	db.StartVacuum(time.Millisecond)
+	db.StartVacuum(time.Millisecond)
+	for shrunk := false; !shrunk; {
+		db.mu.Lock()
+		shrunk = chainLength(db, "x") == 1
+		db.mu.Unlock()
+	}
+
+	db.StopVacuum()
+	assertEq(db.stopVacuum, (chan struct{})(nil), "vacuum stopped")
+
+	// No pass runs once stopped.
+	overwriteCommitted(db, "x", 10)
+	time.Sleep(5 * time.Millisecond)
+	assertEq(chainLength(db, "x"), 11, "x versions")
+	db.StopVacuum()
+}
+
+func TestInProgressTransactions(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+	c3 := db.newConnection()
+
+	c1.mustExecCommand("begin", []string{"snapshot"})
+	c2.mustExecCommand("begin", nil)
+	c3.mustExecCommand("begin", []string{"serializable"})
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	c3.mustExecCommand("set", []string{"x", "c3"})
+	c3.mustExecCommand("set", []string{"y", "c3"})
+	c3.mustExecCommand("exists", []string{"z"})
+	c2.mustExecCommand("commit", nil)
+
+	infos := db.InProgressTransactions()
+	assertEq(len(infos), 2, "in-progress transactions")
+	assertEq(infos[0], TransactionInfo{Id: 1, Isolation: IsolationLevelSnapshot, Reads: 0, Writes: 1}, "c1 info")
+	assertEq(infos[1], TransactionInfo{Id: 3, Isolation: IsolationLevelSerializable, Reads: 1, Writes: 2}, "c3 info")
+
+	res := c2.mustExecCommand("txlist", nil)
+	assertEq(res, "id=1 isolation=snapshot reads=0 writes=1\nid=3 isolation=serializable reads=1 writes=2", "txlist")
+}
+
+func TestConflictIndexPruning(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "c2"})
+	c2.mustExecCommand("commit", nil)
+
+	// c1 may still conflict with c2's commit.
+	db.Vacuum()
+	assertEq(db.lastWrite["x"], uint64(1), "x last written")
+	assertEq(db.commits.Len(), 1, "indexed commits")
+
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	_, err := c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrWriteWriteConflict), "c1 commit")
+
+	db.Vacuum()
+	assertEq(len(db.lastWrite), 0, "indexed keys")
+	assertEq(db.commits.Len(), 0, "indexed commits")
+}
+
+func TestForgetFinishedTransactions(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+
+	c := db.newConnection()
+	for i := 1; i <= 1000; i++ {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", fmt.Sprintf("%d", i)})
+		if i%3 == 0 {
+			c.mustExecCommand("abort", nil)
+		} else {
+			c.mustExecCommand("commit", nil)
+		}
+
+		if i%100 == 0 {
+			db.Vacuum()
+			assertEq(db.transactions.Len(), 0, "transactions")
+		}
+	}
+
+	// The commits made after the reader started are kept so that it can tell
+	// them apart.
+	reader := db.newConnection()
+	reader.mustExecCommand("begin", nil)
+	for i := 0; i < 10; i++ {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", fmt.Sprintf("%d", i)})
+		c.mustExecCommand("commit", nil)
+	}
+
+	db.Vacuum()
+	assertEq(db.transactions.Len(), 11, "transactions")
+	assertEq(reader.mustExecCommand("get", []string{"x"}), "1000", "reader get x")
+	reader.mustExecCommand("commit", nil)
+
+	db.Vacuum()
+	assertEq(db.transactions.Len(), 0, "transactions")
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("get", []string{"x"}), "9", "get x")
+	assertEq(c.mustExecCommand("history", []string{"x"}), "start=1011 end=0 state=committed value=9", "history x")
+}
+
+func TestSameTx(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("mset", []string{"x", "1", "y", "1"})
+	c.mustExecCommand("commit", nil)
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"z", "2"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("sametx", []string{"x", "y"}), "1", "sametx x y")
+	assertEq(c.mustExecCommand("sametx", []string{"x", "z"}), "0", "sametx x z")
+	assertEq(c.mustExecCommand("sametx", []string{"x", "y", "w"}), "0", "sametx x y w")
+}
+
+func TestNoReadYourWrites(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "before"})
+	c.mustExecCommand("commit", nil)
+
+	for _, isolation := range []string{"read_committed", "snapshot"} {
+		c.mustExecCommand("begin", []string{isolation, "no_read_your_writes"})
+		c.mustExecCommand("set", []string{"x", "after"})
+		c.mustExecCommand("set", []string{"y", "after"})
+		assertEq(c.mustExecCommand("get", []string{"x"}), "before", isolation+" get x")
+		_, err := c.execCommand("get", []string{"y"})
+		assert(errors.Is(err, ErrNoSuchKey), isolation+" get y")
+		c.mustExecCommand("abort", nil)
+	}
+
+	c.mustExecCommand("begin", []string{"no_read_your_writes"})
+	c.mustExecCommand("set", []string{"x", "after"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("get", []string{"x"}), "after", "get x")
+}
+
+func TestWatch(t *testing.T) {
+	db := newDatabase()
+	x := db.Watch("x")
+	y := db.Watch("y")
+
+	c := db.newConnection()
+	for i := 0; i < 3; i++ {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", "1"})
+		c.mustExecCommand("commit", nil)
+	}
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"y", "1"})
+	c.mustExecCommand("abort", nil)
+
+	// The three commits were coalesced into a single signal.
+	<-x
+	select {
+	case <-x:
+		panic("x signaled twice")
+	case <-y:
+		panic("y signaled on abort")
+	default:
+	}
+
+	db.Unwatch("x", x)
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "2"})
+	c.mustExecCommand("commit", nil)
+	assertEq(len(x), 0, "x signals after unwatch")
+}
+
+func TestMissingArgs(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+
+	for command, n := range minArgs {
+		_, err := c.execCommand(command, make([]string, n-1))
+		assert(errors.Is(err, ErrWrongArgs), command+" with too few args")
+	}
+
+	_, err := c.execCommand("set", []string{"x"})
+	assertEq(err.Error(), "set: wrong number of arguments", "set error")
+
+	// The transaction is unaffected.
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+}
+
+func TestNamespaces(t *testing.T) {
+	db := newDatabase()
+	a := db.newConnection()
+	b := db.newConnection()
+
+	a.mustExecCommand("use", []string{"A"})
+	b.mustExecCommand("use", []string{"B"})
+
+	idA := a.mustExecCommand("begin", nil)
+	idB := b.mustExecCommand("begin", nil)
+	assertEq(idA, idB, "transaction ids of each namespace")
+
+	a.mustExecCommand("set", []string{"x", "1"})
+	a.mustExecCommand("commit", nil)
+
+	_, err := b.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "x invisible in B")
+
+	_, err = b.execCommand("use", []string{"A"})
+	assert(errors.Is(err, ErrTransactionInProgress), "use in a transaction")
+	b.mustExecCommand("abort", nil)
+
+	b.mustExecCommand("use", []string{"A"})
+	b.mustExecCommand("begin", nil)
+	assertEq(b.mustExecCommand("get", []string{"x"}), "1", "x visible in A")
+	b.mustExecCommand("commit", nil)
+
+	assertEq(len(db.Namespace("A").store), 1, "keys in A")
+	assertEq(db.Namespace("default"), db, "default namespace")
+	assertEq(len(db.store), 0, "keys in default")
+}
+
+func TestNamespaceSettings(t *testing.T) {
+	db := newDatabase()
+	db.MinIsolation = IsolationLevelSerializable
+	db.RegisterProfile("reporting", IsolationLevelSerializable, true)
+	commits := 0
+	db.OnCommit(func(txId uint64, writeset []string) { commits += 1 })
+
+	c := db.newConnection()
+	c.mustExecCommand("use", []string{"other"})
+	_, err := c.execCommand("begin", []string{"read_uncommitted"})
+	assert(errors.Is(err, ErrIsolationTooWeak), "begin read_uncommitted")
+
+	c.mustExecCommand("begin", []string{"profile", "reporting"})
+	_, err = c.execCommand("set", []string{"x", "1"})
+	assert(errors.Is(err, ErrReadOnly), "profile set")
+	c.mustExecCommand("abort", nil)
+
+	c.mustExecCommand("begin", []string{"serializable"})
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+	assertEq(commits, 1, "commit hook calls")
+}
+
+func TestChainInfo(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	for i := range 3 {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", fmt.Sprint(i)})
+		c.mustExecCommand("commit", nil)
+	}
+
+	// Two uncommitted versions on top of the three committed ones, two of
+	// which are superseded.
+	writers := []*Connection{db.newConnection(), db.newConnection()}
+	for _, w := range writers {
+		w.mustExecCommand("begin", nil)
+		w.mustExecCommand("set", []string{"x", "uncommitted"})
+	}
+
+	assertEq(c.mustExecCommand("chaininfo", []string{"x"}), "versions=5 oldest=1 newest=5 invisible=4", "chain info")
+
+	_, err := c.execCommand("chaininfo", []string{"y"})
+	assert(errors.Is(err, ErrNoSuchKey), "missing key")
+}
+
+func TestDeleteIdempotent(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	c.mustExecCommand("begin", nil)
+	_, err := c.execCommand("delete", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "delete absent key")
+	c.mustExecCommand("abort", nil)
+
+	db.DeleteIdempotent = true
+	c.mustExecCommand("begin", []string{"snapshot"})
+	c.mustExecCommand("delete", []string{"x"})
+	assertEq(c.tx.writeset.Len(), 0, "writeset after deleting absent key")
+
+	// A concurrent write of the key is no conflict, as nothing was deleted.
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "1"})
+	c2.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("commit", nil)
+}
+
+func TestNewSnapshot(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("begin", []string{"repeatable_read"})
+	c2.mustExecCommand("set", []string{"x", "1"})
+	c2.mustExecCommand("commit", nil)
+
+	_, err := c1.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "x invisible before refresh")
+
+	assertEq(c1.NewSnapshot(), nil, "new snapshot")
+	assertEq(c1.mustExecCommand("get", []string{"x"}), "1", "x visible after refresh")
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", []string{"snapshot"})
+	assert(errors.Is(c1.NewSnapshot(), ErrIsolationTooStrong), "snapshot isolation")
+}
+
+func TestAssertCommand(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("assert", []string{"x", "NIL"}), "OK", "missing key")
+	c.mustExecCommand("set", []string{"x", "1"})
+	assertEq(c.mustExecCommand("assert", []string{"x", "1"}), "OK", "matching value")
+	assertEq(c.mustExecCommand("assert", []string{"x", "2"}), "FAIL x: expected 2, got 1", "mismatching value")
+	assertEq(c.mustExecCommand("assert", []string{"x", "NIL"}), "FAIL x: expected NIL, got 1", "unexpected value")
+	c.mustExecCommand("commit", nil)
+}
+
+func TestReadCache(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", []string{"repeatable_read"})
+	assertEq(c.mustExecCommand("get", []string{"x"}), "1", "first read")
+	_, cached := c.tx.reads["x"]
+	assert(cached, "x cached")
+
+	c.mustExecCommand("set", []string{"x", "2"})
+	_, cached = c.tx.reads["x"]
+	assert(!cached, "x invalidated by set")
+	assertEq(c.mustExecCommand("get", []string{"x"}), "2", "read own write")
+
+	c.mustExecCommand("savepoint", []string{"s"})
+	c.mustExecCommand("delete", []string{"x"})
+	_, err := c.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "read own delete")
+	c.mustExecCommand("rollback", []string{"s"})
+	assertEq(c.mustExecCommand("get", []string{"x"}), "2", "read after rollback")
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", []string{"repeatable_read"})
+	assertEq(len(c.tx.reads), 0, "cache of a new transaction")
+}
+
+func TestEmptyValue(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", ""})
+
+	assertEq(c.mustExecCommand("exists", []string{"x"}), "1", "exists empty")
+	assertEq(c.mustExecCommand("isnull", []string{"x"}), "0", "isnull empty")
+	res, err := c.ExecCommand("get", []string{"x"})
+	assertEq(err, nil, "get empty")
+	assertEq(res, Result{Value: "", Found: true, Kind: ResultKindOk}, "get empty")
+
+	assertEq(c.mustExecCommand("exists", []string{"y"}), "0", "exists absent")
+	assertEq(c.mustExecCommand("isnull", []string{"y"}), "1", "isnull absent")
+	res, err = c.ExecCommand("get", []string{"y"})
+	assertEq(err, nil, "get absent")
+	assertEq(res.Kind, ResultKindNotFound, "get absent")
+	c.mustExecCommand("commit", nil)
+}
+
+func TestCheckKeys(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", []string{"snapshot"})
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"y", "1"})
+	c2.mustExecCommand("commit", nil)
+
+	assertEq(c1.mustExecCommand("checkkeys", []string{"x", "y", "z"}), "y", "conflicting keys")
+	assertEq(c1.tx.readset.Len(), 0, "readset")
+
+	c1.mustExecCommand("set", []string{"y", "2"})
+	_, err := c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrWriteWriteConflict), "commit conflict")
+}
+
+func TestConflictKeys(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", []string{"snapshot"})
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("set", []string{"y", "1"})
+	c2.mustExecCommand("set", []string{"y", "2"})
+	c2.mustExecCommand("set", []string{"z", "2"})
+	c2.mustExecCommand("commit", nil)
+
+	_, err := c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrWriteWriteConflict), "c1 commit")
+	conflict := &ConflictError{}
+	assert(errors.As(err, &conflict), "conflict error")
+	assert(slices.Equal(conflict.Keys, []string{"y"}), "conflicting keys")
+	assertEq(err.Error(), ErrWriteWriteConflict.Error(), "error message")
+}
+
+func TestMaxKeys(t *testing.T) {
+	db := newDatabase()
+	db.MaxKeys = 2
+	c := db.newConnection()
+	c.Autocommit = true
+
+	c.mustExecCommand("set", []string{"a", "1"})
+	c.mustExecCommand("set", []string{"b", "1"})
+	c.mustExecCommand("get", []string{"a"})
+	c.mustExecCommand("set", []string{"c", "1"})
+
+	_, ok := db.store["b"]
+	assert(!ok, "coldest key evicted")
+	assertEq(len(db.store), 2, "stored keys")
+
+	// Both keys can still be read by the repeatable read transaction, so
+	// none is evicted while it is in progress.
+	reader := db.newConnection()
+	reader.mustExecCommand("begin", []string{"repeatable_read"})
+	c.mustExecCommand("set", []string{"d", "1"})
+	assertEq(len(db.store), 3, "stored keys while protected")
+	assertEq(reader.mustExecCommand("get", []string{"a"}), "1", "protected key")
+	reader.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("set", []string{"e", "1"})
+	_, ok = db.store["c"]
+	assert(!ok, "coldest key evicted once unprotected")
+}
+
+func TestCopy(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	assertEq(c1.mustExecCommand("copy", []string{"x", "y"}), "1", "copy")
+	assertEq(c1.mustExecCommand("get", []string{"y"}), "1", "copied value")
+	_, err := c1.execCommand("copy", []string{"z", "y"})
+	assert(errors.Is(err, ErrNoSuchKey), "copy missing key")
+	c1.mustExecCommand("commit", nil)
+
+	// The source is overwritten between the copy and its commit.
+	c1.mustExecCommand("begin", nil)
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("copy", []string{"x", "z"})
+	c2.mustExecCommand("set", []string{"x", "2"})
+	c2.mustExecCommand("commit", nil)
+
+	_, err = c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "copy conflict")
+}
+
+func TestAppend(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("append", []string{"x", "ab"}), "2", "append to missing key")
+	assertEq(c1.mustExecCommand("append", []string{"x", "cde"}), "5", "append again")
+	assertEq(c1.mustExecCommand("get", []string{"x"}), "abcde", "appended value")
+	c1.mustExecCommand("commit", nil)
+}
+
+func TestAppendConflict(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("append", []string{"x", "a"})
+	c2.mustExecCommand("append", []string{"x", "b"})
+	c1.mustExecCommand("commit", nil)
+
+	_, err := c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrWriteWriteConflict), "concurrent append")
+}
+
+func TestGetAsTime(t *testing.T) {
+	db := newDatabase()
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	db.now = func() time.Time { return now }
+
+	c := db.newConnection()
+	for i, value := range []string{"a", "b", "c"} {
+		now = now.Add(time.Duration(i+1) * time.Minute)
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", value})
+		c.mustExecCommand("commit", nil)
+	}
+
+	// Committed at 12:01, 12:03 and 12:06.
+	for at, expected := range map[string]string{
+		"2024-01-01T12:01:00Z": "a",
+		"2024-01-01T12:02:59Z": "a",
+		"2024-01-01T12:03:00Z": "b",
+		"2024-01-01T12:05:00Z": "b",
+		"2024-01-01T13:00:00Z": "c",
+	} {
+		assertEq(c.mustExecCommand("getastime", []string{at, "x"}), expected, "x at "+at)
+	}
+
+	_, err := c.execCommand("getastime", []string{"2024-01-01T12:00:00Z", "x"})
+	assert(errors.Is(err, ErrNoSuchKey), "x before the first commit")
+	_, err = c.execCommand("getastime", []string{"noon", "x"})
+	assert(errors.Is(err, ErrInvalidTime), "invalid time")
+
+	db.Vacuum()
+	_, err = c.execCommand("getastime", []string{"2024-01-01T12:05:00Z", "x"})
+	assert(errors.Is(err, ErrHistoryUnavailable), "x after vacuum")
+
+	// Times from the last dropped commit on can still be read.
+	assertEq(c.mustExecCommand("getastime", []string{"2024-01-01T12:06:00Z", "x"}), "c", "x at the last commit")
+	assertEq(c.mustExecCommand("getastime", []string{"2024-01-01T13:00:00Z", "x"}), "c", "x after the last commit")
+}
+
+func TestShutdown(t *testing.T) {
+	db := newDatabase()
+	db.StartVacuum(time.Millisecond)
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"y", "1"})
+
+	db.Shutdown()
+	assertEq(db.Stats().Aborted, uint64(2), "aborted transactions")
+	assertEq(len(db.store), 0, "rolled back writes")
+
+	_, err := c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrDatabaseClosed), "commit after shutdown")
+	_, err = db.newConnection().execCommand("begin", nil)
+	assert(errors.Is(err, ErrDatabaseClosed), "begin after shutdown")
+}
+
+func TestShutdownNamespaces(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("use", []string{"other"})
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+
+	db.Shutdown()
+	ns := db.Namespace("other")
+	assertEq(ns.Stats().Aborted, uint64(1), "aborted transactions")
+	assertEq(len(ns.store), 0, "rolled back writes")
+
+	_, err := c.execCommand("commit", nil)
+	assert(errors.Is(err, ErrDatabaseClosed), "commit after shutdown")
+	_, err = db.Namespace("new").newConnection().execCommand("begin", nil)
+	assert(errors.Is(err, ErrDatabaseClosed), "begin in a new namespace")
+}
+
+func TestProfiles(t *testing.T) {
+	db := newDatabase()
+	db.RegisterProfile("reporting", IsolationLevelReadCommitted, true)
+	db.RegisterProfile("payment", IsolationLevelSerializable, false)
+	c := db.newConnection()
+
+	c.mustExecCommand("begin", []string{"profile", "reporting"})
+	assertEq(c.tx.isolation, IsolationLevelReadCommitted, "reporting isolation")
+	_, err := c.execCommand("set", []string{"x", "1"})
+	assert(errors.Is(err, ErrReadOnly), "reporting write")
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", []string{"profile", "payment"})
+	assertEq(c.tx.isolation, IsolationLevelSerializable, "payment isolation")
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+
+	_, err = c.execCommand("begin", []string{"profile", "batch"})
+	assert(errors.Is(err, ErrNoSuchProfile), "unknown profile")
+	_, err = c.execCommand("begin", []string{"profile"})
+	assert(errors.Is(err, ErrWrongArgs), "missing profile name")
+}
+
+func TestMemStats(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "abc"})
+	c.mustExecCommand("set", []string{"y", "hello"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "abcdefg"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"z", "discarded"})
+	c.mustExecCommand("abort", nil)
+
+	assertEq(db.MemStats(), MemStats{
+		Keys:                  2,
+		Versions:              3,
+		ValueBytes:            3 + 5 + 7,
+		CommittedTransactions: 2,
+		AbortedTransactions:   1,
+	}, "memory stats")
+	assertEq(c.mustExecCommand("memstats", nil), "keys=2 versions=3 value_bytes=15 committed=2 aborted=1", "memstats")
+}
+
+func TestWaitForKey(t *testing.T) {
+	db := newDatabase()
+	waiter := db.newConnection()
+
+	assert(!waiter.WaitForKey("x", "ready", time.Millisecond), "times out")
+
+	done := make(chan bool)
+	go func() {
+		done <- waiter.WaitForKey("x", "ready", 10*time.Second)
+	}()
+
+	c := db.newConnection()
+	for _, value := range []string{"starting", "ready"} {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", value})
+		c.mustExecCommand("commit", nil)
+	}
+
+	assert(<-done, "x became ready")
+}
+
+func TestRename(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("set", []string{"y", "2"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("rename", []string{"x", "y"}), "1", "rename")
+	assertEq(c.mustExecCommand("get", []string{"y"}), "1", "y in transaction")
+	_, err := c.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "x in transaction")
+	assert(c.tx.writeset.Contains("x") && c.tx.writeset.Contains("y"), "writeset")
+	_, err = c.execCommand("rename", []string{"x", "z"})
+	assert(errors.Is(err, ErrNoSuchKey), "rename missing key")
+	c.mustExecCommand("rename", []string{"y", "y"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("get", []string{"y"}), "1", "y after commit")
+	_, err = c.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "x after commit")
+	c.mustExecCommand("commit", nil)
+}
+
+func TestOldestActiveTransaction(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+	c3 := db.newConnection()
+
+	assertEq(db.OldestActiveTransaction(), uint64(1), "no transactions")
+
+	c1.mustExecCommand("begin", nil)
+	c2.mustExecCommand("begin", nil)
+	c3.mustExecCommand("begin", nil)
+	c2.mustExecCommand("abort", nil)
+	assertEq(db.OldestActiveTransaction(), uint64(1), "oldest active")
+
+	c1.mustExecCommand("commit", nil)
+	assertEq(c3.mustExecCommand("oldesttx", nil), "3", "oldesttx")
+
+	c3.mustExecCommand("commit", nil)
+	assertEq(db.OldestActiveTransaction(), uint64(4), "none active")
+}
+
+func TestPrepare(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	assertEq(c1.Prepare(), nil, "prepare")
+	assertEq(c1.tx.state, TransactionStatePrepared, "prepared state")
+	_, err := c1.execCommand("set", []string{"y", "1"})
+	assert(errors.Is(err, ErrTransactionPrepared), "write after prepare")
+
+	// The prepared write is invisible, and a conflicting commit fails
+	// instead of the prepared transaction.
+	c2.mustExecCommand("begin", nil)
+	_, err = c2.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "prepared write invisible")
+	c2.mustExecCommand("set", []string{"x", "2"})
+	_, err = c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrWriteWriteConflict), "commit conflicting with prepared")
+
+	assertEq(c1.Commit(), nil, "commit prepared")
+	c2.mustExecCommand("begin", nil)
+	assertEq(c2.mustExecCommand("get", []string{"x"}), "1", "committed write")
+	c2.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "3"})
+	assertEq(c1.Prepare(), nil, "prepare")
+	assertEq(c1.Rollback(), nil, "rollback prepared")
+	c2.mustExecCommand("begin", nil)
+	assertEq(c2.mustExecCommand("get", []string{"x"}), "1", "rolled back write")
+	c2.mustExecCommand("set", []string{"x", "4"})
+	c2.mustExecCommand("commit", nil)
+}
+
+func TestDoomed(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", []string{"serializable"})
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("get", []string{"x", "status"})
+	assertEq(c1.mustExecCommand("doomed", nil), "0", "before conflicting commit")
+
+	c2.mustExecCommand("set", []string{"x", "1"})
+	assertEq(c1.mustExecCommand("doomed", nil), "0", "before conflicting commit")
+	c2.mustExecCommand("commit", nil)
+	assertEq(c1.mustExecCommand("doomed", nil), "1", "after conflicting commit")
+
+	_, err := c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "doomed commit")
+}
+
+func TestOnExpire(t *testing.T) {
+	db := newDatabase()
+	now := time.Unix(1000, 0)
+	db.now = func() time.Time { return now }
+
+	expired := []string{}
+	db.OnExpire(func(key string) { expired = append(expired, key) })
+
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("setex", []string{"lease", "owner", "10"})
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("get", []string{"lease"}), "owner", "lease before expiry")
+	c.mustExecCommand("commit", nil)
+	assertEq(len(expired), 0, "expired before expiry")
+
+	now = now.Add(11 * time.Second)
+	c.mustExecCommand("begin", nil)
+	_, err := c.execCommand("get", []string{"lease"})
+	assert(errors.Is(err, ErrNoSuchKey), "lease after expiry")
+	c.execCommand("get", []string{"lease"})
+	c.mustExecCommand("get", []string{"x"})
+	c.mustExecCommand("commit", nil)
+	db.Vacuum()
+
+	assert(slices.Equal(expired, []string{"lease"}), "expired keys")
+}
+
+func TestTransfer(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"alice", "100"})
+	assertEq(c1.mustExecCommand("transfer", []string{"alice", "bob", "30"}), "70\n30", "transfer")
+	_, err := c1.execCommand("transfer", []string{"bob", "alice", "31"})
+	assert(errors.Is(err, ErrInsufficientFunds), "overdraft")
+	_, err = c1.execCommand("transfer", []string{"bob", "alice", "-1"})
+	assert(errors.Is(err, ErrNotPositive), "negative amount")
+	assertEq(c1.mustExecCommand("transfer", []string{"bob", "bob", "5"}), "30\n30", "transfer to self")
+	c1.mustExecCommand("commit", nil)
+
+	// Both spend the same 70, only one may commit.
+	c1.mustExecCommand("begin", nil)
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("transfer", []string{"alice", "bob", "70"})
+	c2.mustExecCommand("transfer", []string{"alice", "carol", "70"})
+	c1.mustExecCommand("commit", nil)
+	_, err = c2.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "double spend")
+
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("mget", []string{"alice", "bob", "carol"}), "0\n100\n", "balances")
+	c1.mustExecCommand("commit", nil)
+}
+
+func TestValueAwareConflicts(t *testing.T) {
+	for _, valueAware := range []bool{false, true} {
+		db := newDatabase()
+		db.defaultIsolation = IsolationLevelSnapshot
+		db.ValueAwareConflicts = valueAware
+		c1 := db.newConnection()
+		c2 := db.newConnection()
+
+		c1.mustExecCommand("begin", nil)
+		c2.mustExecCommand("begin", nil)
+		c1.mustExecCommand("set", []string{"x", "same"})
+		c2.mustExecCommand("set", []string{"x", "same"})
+		c1.mustExecCommand("commit", nil)
+
+		_, err := c2.execCommand("commit", nil)
+		if !valueAware {
+			assert(errors.Is(err, ErrWriteWriteConflict), "key-based conflict")
+			continue
+		}
+		assertEq(err, nil, "value-aware commit")
+
+		// The redundant write was dropped, leaving a single live version.
+		c1.mustExecCommand("begin", nil)
+		assertEq(c1.mustExecCommand("history", []string{"x"}), "start=1 end=0 state=committed value=same", "history x")
+		c1.mustExecCommand("delete", []string{"x"})
+		c1.mustExecCommand("commit", nil)
+		c1.mustExecCommand("begin", nil)
+		_, err = c1.execCommand("get", []string{"x"})
+		assert(errors.Is(err, ErrNoSuchKey), "deleted x")
+		c1.mustExecCommand("commit", nil)
+
+		// Different values still conflict.
+		c1.mustExecCommand("begin", nil)
+		c2.mustExecCommand("begin", nil)
+		c1.mustExecCommand("set", []string{"x", "a"})
+		c2.mustExecCommand("set", []string{"x", "b"})
+		c1.mustExecCommand("commit", nil)
+		_, err = c2.execCommand("commit", nil)
+		assert(errors.Is(err, ErrWriteWriteConflict), "different values")
+	}
+}
+
+func TestValueAwareConflictsKeepCommittedMarks(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+	db.ValueAwareConflicts = true
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "old"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "same"})
+	c2.mustExecCommand("set", []string{"x", "same"})
+	c2.mustExecCommand("commit", nil)
+	c1.mustExecCommand("commit", nil)
+
+	// Dropping the redundant write keeps the committed overwrite of old.
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("history", []string{"x"}), "start=1 end=3 state=committed value=old\nstart=3 end=0 state=committed value=same", "history x")
+	c1.mustExecCommand("delete", []string{"x"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	_, err := c1.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "deleted x")
+}
+
+func TestDelPrefix(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("mset", []string{"session:1", "a", "session:2", "b", "session:3", "c", "user:1", "d"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("delprefix", []string{"session:"}), "3", "deleted keys")
+	assertEq(c1.mustExecCommand("scan", []string{"session:"}), "", "session keys")
+	assertEq(c1.mustExecCommand("get", []string{"user:1"}), "d", "other key")
+	c1.mustExecCommand("commit", nil)
+
+	// A concurrent insert into the prefix conflicts with the delete.
+	c1.mustExecCommand("begin", nil)
+	c2.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("delprefix", []string{"session:"}), "0", "nothing to delete")
+	c1.mustExecCommand("set", []string{"user:2", "e"})
+	c2.mustExecCommand("set", []string{"session:4", "f"})
+	c2.mustExecCommand("commit", nil)
+	_, err := c1.execCommand("commit", nil)
+	assert(errors.Is(err, ErrReadWriteConflict), "concurrent insert")
+}
+
+func TestGetMeta(t *testing.T) {
+	db := newDatabase()
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "2"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	assertEq(c1.mustExecCommand("getmeta", []string{"x"}), "value=2 start=2 latest=true", "newest version")
+
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"x", "3"})
+	assertEq(c1.mustExecCommand("getmeta", []string{"x"}), "value=2 start=2 latest=false", "uncommitted newer version")
+	c2.mustExecCommand("abort", nil)
+	c1.mustExecCommand("commit", nil)
+}
+
+func TestDirty(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"b", "1"})
+	c.mustExecCommand("commit", nil)
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("dirty", nil), "", "nothing written")
+	c.mustExecCommand("set", []string{"c", "1"})
+	c.mustExecCommand("set", []string{"a", "1"})
+	c.mustExecCommand("delete", []string{"b"})
+	c.mustExecCommand("get", []string{"a"})
+	assertEq(c.mustExecCommand("dirty", nil), "a\nb\nc", "written keys")
+	c.mustExecCommand("commit", nil)
+}
+
+func TestSavepoint(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("savepoint", []string{"s"})
+	c1.mustExecCommand("set", []string{"x", "2"})
+	c1.mustExecCommand("set", []string{"y", "2"})
+	c1.mustExecCommand("delete", []string{"x"})
+
+	c1.mustExecCommand("rollback", []string{"s"})
+
+	res := c1.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c1 get x")
+
+	_, err := c1.execCommand("get", []string{"y"})
+	assert(errors.Is(err, ErrNoSuchKey), "c1 get y")
+
+	_, err = c1.execCommand("rollback", []string{"nope"})
+	assert(errors.Is(err, ErrNoSuchSavepoint), "c1 rollback nope")
+
+	// y is no longer in the writeset so a concurrent write to it does not
+	// conflict.
+	c2.mustExecCommand("set", []string{"y", "c2"})
+	c2.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("commit", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+	res = c3.mustExecCommand("get", []string{"x"})
+	assertEq(res, "1", "c3 get x")
+	assertEq(chainLength(db, "x"), 1, "x versions")
+}
+
+func TestSnapshotIsolation_first_updater_wins(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSnapshot
+	db.FirstUpdaterWins = true
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "c1"})
+
+	// The conflict is detected on write, not on commit.
+	_, err := c2.execCommand("set", []string{"x", "c2"})
+	assert(errors.Is(err, ErrWriteWriteConflict), "c2 set x")
+	assert(c2.tx == nil, "c2 aborted")
+	assertEq(db.transaction(2).state, TransactionStateAborted, "c2 aborted")
+
+	// Including transactions that already committed.
+	c1.mustExecCommand("commit", nil)
+
+	_, err = c3.execCommand("set", []string{"x", "c3"})
+	assert(errors.Is(err, ErrWriteWriteConflict), "c3 set x")
+
+	// And concurrent deletes.
+	c4 := db.newConnection()
+	c4.mustExecCommand("begin", nil)
+
+	c5 := db.newConnection()
+	c5.mustExecCommand("begin", nil)
+
+	c4.mustExecCommand("delete", []string{"x"})
+
+	_, err = c5.execCommand("set", []string{"x", "c5"})
+	assert(errors.Is(err, ErrWriteWriteConflict), "c5 set x")
+	c4.mustExecCommand("commit", nil)
+
+	// Non-concurrent writes are fine.
+	c6 := db.newConnection()
+	c6.mustExecCommand("begin", nil)
+	c6.mustExecCommand("set", []string{"x", "c6"})
+	c6.mustExecCommand("delete", []string{"x"})
+	c6.mustExecCommand("commit", nil)
+}
+
+func TestSerializableIsolation_readwrite_conflict(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	c1.mustExecCommand("set", []string{"x", "hey"})
+	c1.mustExecCommand("commit", nil)
+
+	_, err := c2.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "c5 get x")
+
+	res, err := c2.execCommand("commit", nil)
+	assertEq(res, "", "c2 commit")
+	assert(errors.Is(err, ErrReadWriteConflict), "c2 commit")
+
+	// But unrelated keys cause no conflict.
+	c3.mustExecCommand("set", []string{"y", "no conflict"})
+	c3.mustExecCommand("commit", nil)
+}
+
+func TestGetStatus(t *testing.T) {
+	for _, isolation := range []IsolationLevel{
+		IsolationLevelReadUncommitted,
+		IsolationLevelReadCommitted,
+		IsolationLevelRepeatableRead,
+		IsolationLevelSnapshot,
+		IsolationLevelSerializable,
+	} {
+		db := newDatabase()
+		db.defaultIsolation = isolation
+
+		c1 := db.newConnection()
+		c1.mustExecCommand("begin", nil)
+		c1.mustExecCommand("set", []string{"x", "hey"})
+		c1.mustExecCommand("set", []string{"y", "hey"})
+		c1.mustExecCommand("commit", nil)
+
+		c2 := db.newConnection()
+		c2.mustExecCommand("begin", nil)
+		c2.mustExecCommand("delete", []string{"y"})
+		c2.mustExecCommand("commit", nil)
+
+		c3 := db.newConnection()
+		c3.mustExecCommand("begin", nil)
+
+		res := c3.mustExecCommand("get", []string{"x", "status"})
+		assertEq(res, "present", "c3 get x status")
+		assertEq(c3.GetStatus("x"), KeyStatusPresent, "c3 status x")
+
+		res = c3.mustExecCommand("get", []string{"y", "status"})
+		assertEq(res, "deleted", "c3 get y status")
+		assertEq(c3.GetStatus("y"), KeyStatusDeleted, "c3 status y")
+
+		res = c3.mustExecCommand("get", []string{"z", "status"})
+		assertEq(res, "never-existed", "c3 get z status")
+		assertEq(c3.GetStatus("z"), KeyStatusNeverExisted, "c3 status z")
+
+		// A delete by the transaction itself is reported as deleted.
+		c3.mustExecCommand("delete", []string{"x"})
+		res = c3.mustExecCommand("get", []string{"x", "status"})
+		assertEq(res, "deleted", "c3 get x status after delete")
+	}
+}
+
+func TestSerializationGraph(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelRepeatableRead
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "hey"})
+	c1.mustExecCommand("commit", nil)
+
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+
+	c3 := db.newConnection()
+	c3.mustExecCommand("begin", nil)
+
+	// c2 reads what c1 wrote and writes a key that c3 reads.
+	c2.mustExecCommand("get", []string{"x"})
+	c2.mustExecCommand("set", []string{"y", "hey"})
+
+	// c3 cannot see c2's write since they are concurrent.
+	_, err := c3.execCommand("get", []string{"y"})
+	assert(errors.Is(err, ErrNoSuchKey), "c3 get y")
+	c3.mustExecCommand("set", []string{"x", "yall"})
+
+	c2.mustExecCommand("commit", nil)
+	c3.mustExecCommand("commit", nil)
+
+	// Aborted transactions are not part of the graph.
+	c4 := db.newConnection()
+	c4.mustExecCommand("begin", nil)
+	c4.mustExecCommand("set", []string{"x", "aborted"})
+	c4.mustExecCommand("abort", nil)
+
+	graph := db.SerializationGraph()
+	assertEq(len(graph), 4, "graph edges")
+	assertEq(graph[0], Dependency{From: 1, To: 2, Kind: "wr"}, "c1 -> c2")
+	assertEq(graph[1], Dependency{From: 1, To: 3, Kind: "ww"}, "c1 -> c3")
+	assertEq(graph[2], Dependency{From: 3, To: 2, Kind: "rw"}, "c3 -> c2")
+	assertEq(graph[3], Dependency{From: 2, To: 3, Kind: "rw"}, "c2 -> c3")
+
+	res := c4.mustExecCommand("graph", nil)
+	assertEq(res, "1 -wr-> 2\n1 -ww-> 3\n3 -rw-> 2\n2 -rw-> 3", "graph command")
+}
+
+func TestRepl(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	in := strings.NewReader("begin\nset x hey\n\nget x\nget y\ngetset z 1\ncommit\nbegin\nset y yall\n")
+	out := bytes.Buffer{}
+	err := c.repl(in, &out)
+	assertEq(err, nil, "repl")
+	assertEq(out.String(), "1\nhey\nhey\nERROR: no such key\nNIL\n\n2\nyall\n", "repl output")
+
+	// The transaction left open at EOF was aborted.
+	assert(c.tx == nil, "no open transaction")
+	assertEq(db.transaction(2).state, TransactionStateAborted, "transaction 2 aborted")
+}
+
+func TestReplRawValues(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+
+	value := "hello world\nwith\x00bytes\n"
+	in := strings.NewReader(fmt.Sprintf("begin\nsetraw x %d\n%sgetraw x\nsetraw y\ncommit\n", len(value), value))
+	out := bytes.Buffer{}
+	err := c.repl(in, &out)
+	assertEq(err, nil, "repl")
+
+	expected := fmt.Sprintf("1\n%s\n%d\n%s\nERROR: wrong number of arguments\n\n", value, len(value), value)
+	assertEq(out.String(), expected, "repl output")
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("get", []string{"x"}), value, "get x")
+
+	// Outside the REPL the value is passed as it is.
+	res, err := c.ExecCommand("setraw", []string{"y", value})
+	assertEq(err, nil, "setraw y")
+	assertEq(res.Value, value, "setraw y")
+	assertEq(c.mustExecCommand("getraw", []string{"y"}), fmt.Sprintf("%d\n%s", len(value), value), "getraw y")
+}
+
+func TestConcurrentConnections(t *testing.T) {
+	db := newDatabase()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c := db.newConnection()
+			c.mustExecCommand("begin", nil)
+			c.mustExecCommand("set", []string{fmt.Sprintf("k%d", i%5), fmt.Sprintf("%d", i)})
+			c.mustExecCommand("commit", nil)
+		}()
+	}
+	wg.Wait()
+
+	// Every transaction got a distinct id and wrote exactly one version.
+	assertEq(db.nextTransactionId, uint64(51), "next transaction id")
+	assertEq(db.transactions.Len(), 50, "transaction count")
+
+	versions := 0
+	for _, chain := range db.store {
+		versions += chain.Len()
+	}
+	assertEq(versions, 50, "version count")
+}
+
+func TestVacuum(t *testing.T) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelRepeatableRead
+
+	c := db.newConnection()
+	for i := 0; i < 1000; i++ {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", fmt.Sprintf("%d", i)})
+		c.mustExecCommand("commit", nil)
+	}
+
+	// An in-progress transaction keeps the versions it can see.
+	reader := db.newConnection()
+	reader.mustExecCommand("begin", nil)
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "new"})
+	c.mustExecCommand("commit", nil)
+
+	assertEq(db.Vacuum(), 999, "removed versions")
+	assertEq(chainLength(db, "x"), 2, "x versions")
+
+	res := reader.mustExecCommand("get", []string{"x"})
+	assertEq(res, "999", "reader get x")
+	reader.mustExecCommand("commit", nil)
+
+	// Once the reader is done only the latest value remains.
+	assertEq(db.Vacuum(), 1, "removed versions")
+	assertEq(chainLength(db, "x"), 1, "x versions")
+
+	c.mustExecCommand("begin", nil)
+	res = c.mustExecCommand("get", []string{"x"})
+	assertEq(res, "new", "get x")
+}
+
+func TestVacuumForgetsAbortedTransactions(t *testing.T) {
+	db := newDatabase()
+	c0 := db.newConnection()
+	c0.mustExecCommand("begin", nil)
+	c0.mustExecCommand("set", []string{"x", "a"})
+	c0.mustExecCommand("commit", nil)
+
+	c1 := db.newConnection()
+	c2 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c2.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "c1"})
+	c2.mustExecCommand("set", []string{"x", "c2"})
+	c1.mustExecCommand("abort", nil)
+	c2.mustExecCommand("abort", nil)
+
+	// The aborted transactions left no marks that could pass for committed
+	// deletes once vacuum forgets them.
+	assertEq(c0.mustExecCommand("history", []string{"x"}), "start=1 end=0 state=committed value=a", "history x")
+	db.Vacuum()
+	db.Vacuum()
+	_, ok := db.transactions.Get(2)
+	assert(!ok, "aborted transaction forgotten")
+
+	c0.mustExecCommand("begin", nil)
+	assertEq(c0.mustExecCommand("get", []string{"x"}), "a", "get x")
+}
+
+func chainLength(db *Database, key string) int {
+	if chain, ok := db.store[key]; ok {
+		return chain.Len()
+	}
+	return 0
+}
+
+// Commits n transactions each overwriting the key, bypassing begin so that the
+// setup doesn't compute the in-progress set of every transaction.
+func overwriteCommitted(db *Database, key string, n int) {
+	for i := 0; i < n; i++ {
+		t := &Transaction{
+			id:        db.nextTransactionId,
+			isolation: db.defaultIsolation,
+			state:     TransactionStateInProgress,
+			snapshot:  db.nextCommitId - 1,
+		}
+		db.nextTransactionId += 1
+		db.transactions.Set(t.id, t)
+
+		db.set(t, key, fmt.Sprintf("%d", i))
+		db.stats.InProgress += 1
+		db.endTransaction(t, TransactionStateCommitted)
+	}
+}
+
+func BenchmarkCommitConflictCheck(b *testing.B) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelSerializable
+
+	// The writer has to be checked against all the transactions committed
+	// after it started.
+	writer := db.newConnection()
+	writer.mustExecCommand("begin", nil)
+	writer.mustExecCommand("exists", []string{"x"})
+	writer.mustExecCommand("set", []string{"x", "writer"})
+	overwriteCommitted(db, "y", 100_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		assertEq(db.commitConflict(writer.tx), nil, "writer conflict")
+	}
+}
+
+func BenchmarkGetLongChain(b *testing.B) {
+	db := newDatabase()
+	db.defaultIsolation = IsolationLevelRepeatableRead
+	overwriteCommitted(db, "x", 1)
+
+	// The reader has to skip all the versions committed after it started.
+	reader := db.newConnection()
+	reader.mustExecCommand("begin", nil)
+	overwriteCommitted(db, "x", 100_000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res := reader.mustExecCommand("get", []string{"x"})
+		assertEq(res, "0", "reader get x")
+	}
+}
+
+func BenchmarkGetLongChainLargeValues(b *testing.B) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "0"})
+	c.mustExecCommand("commit", nil)
+
+	// The writers are in progress when the reader begins, so their versions
+	// sort below it and the reader walks over every one of them, each holding
+	// 64KiB, down to the value it can see.
+	writers := []*Connection{}
+	for i := range 1_000 {
+		w := db.newConnection()
+		w.mustExecCommand("begin", nil)
+		w.mustExecCommand("set", []string{"x", strings.Repeat(fmt.Sprint(i%10), 64<<10)})
+		writers = append(writers, w)
+	}
+
+	reader := db.newConnection()
+	reader.mustExecCommand("begin", []string{"repeatable_read"})
+
+	for _, w := range writers {
+		w.mustExecCommand("commit", nil)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	// Not through get, which would only walk the chain once and then read
+	// from the transaction's cache.
+	for i := 0; i < b.N; i++ {
+		value, ok := db.visibleVersion(reader.tx, "x")
+		assert(ok && value.value == "0", "reader get x")
+	}
+}
+
+// Repeated gets of one key by a reader that has to skip a long chain, through
+// the transaction's cache and walking the chain every time.
+func BenchmarkRepeatedGets(b *testing.B) {
+	db := newDatabase()
+	overwriteCommitted(db, "x", 1)
+
+	reader := db.newConnection()
+	reader.mustExecCommand("begin", []string{"repeatable_read"})
+	overwriteCommitted(db, "x", 1_000)
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for range 10_000 {
+				db.get(reader.tx, "x")
+			}
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for range 10_000 {
+				db.visibleVersion(reader.tx, "x")
+			}
+		}
+	})
 }
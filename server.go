@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+)
+
+// Accepts TCP connections on addr and serves each from its own goroutine with
+// its own Connection, so every client has at most one transaction in flight.
+//
+// The wire format is line based. A request is a command followed by its
+// arguments, separated by spaces and terminated by a newline:
+//
+//	command SP arg SP arg\n
+//
+// Each request gets a reply holding the command result terminated by a
+// newline, or "ERROR: <message>\n" if the command failed. A transaction still
+// open when the client closes the socket is aborted.
+func (d *Database) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return d.serve(l)
+}
+
+func (d *Database) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			debug("accepted connection from", conn.RemoteAddr())
+			c := d.newConnection()
+			if err := c.repl(conn, conn); err != nil {
+				debug("connection error", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
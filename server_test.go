@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assertEq(err, nil, "listen")
+	defer l.Close()
+
+	db := newDatabase()
+	go db.serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assertEq(err, nil, "dial")
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	request := func(line string) string {
+		_, err := fmt.Fprintf(conn, "%s\n", line)
+		assertEq(err, nil, "write request")
+		reply, err := reader.ReadString('\n')
+		assertEq(err, nil, "read reply")
+		return reply
+	}
+
+	assertEq(request("begin"), "1\n", "begin")
+	assertEq(request("set x hey"), "hey\n", "set x")
+	assertEq(request("commit"), "\n", "commit")
+	assertEq(request("begin"), "2\n", "begin")
+	assertEq(request("get x"), "hey\n", "get x")
+	assertEq(request("get y"), "ERROR: no such key\n", "get y")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// A single command queued on a simulated connection. Check, when set, is
+// called with the result of the command and fails the simulation by returning
+// an error.
+type Step struct {
+	Command string
+	Args    []string
+	Check   func(res string, err error) error
+}
+
+type SimConnection struct {
+	id    int
+	conn  *Connection
+	steps []Step
+}
+
+// Queues a step to be executed on this connection once the scheduler picks it.
+// Steps of the same connection always run in the order they are enqueued.
+func (s *SimConnection) Enqueue(command string, args []string, check func(res string, err error) error) {
+	s.steps = append(s.steps, Step{Command: command, Args: args, Check: check})
+}
+
+// Interleaves the steps of several simulated connections in an order fully
+// determined by the seed, so that a failing interleaving can be reproduced by
+// running the scheduler again with the same seed.
+type Scheduler struct {
+	seed  int64
+	rand  *rand.Rand
+	db    *Database
+	conns []*SimConnection
+	trace []string
+}
+
+func newScheduler(db *Database, seed int64) *Scheduler {
+	return &Scheduler{
+		seed: seed,
+		rand: rand.New(rand.NewSource(seed)),
+		db:   db,
+	}
+}
+
+func (s *Scheduler) newConnection() *SimConnection {
+	c := &SimConnection{
+		id:   len(s.conns) + 1,
+		conn: s.db.newConnection(),
+	}
+	s.conns = append(s.conns, c)
+	return c
+}
+
+// The steps executed so far, one per line in execution order.
+func (s *Scheduler) Interleaving() []string {
+	return s.trace
+}
+
+// Executes all queued steps, picking the next connection to step at random.
+// Returns an error describing the interleaving so far on the first failing
+// check.
+func (s *Scheduler) Run() error {
+	for {
+		pending := []*SimConnection{}
+		for _, c := range s.conns {
+			if len(c.steps) > 0 {
+				pending = append(pending, c)
+			}
+		}
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		c := pending[s.rand.Intn(len(pending))]
+		step := c.steps[0]
+		c.steps = c.steps[1:]
+
+		res, err := c.conn.execCommand(step.Command, step.Args)
+		s.trace = append(s.trace, fmt.Sprintf("c%d: %s", c.id, strings.Join(append([]string{step.Command}, step.Args...), " ")))
+
+		if step.Check == nil {
+			continue
+		}
+
+		if checkErr := step.Check(res, err); checkErr != nil {
+			return fmt.Errorf("%w\ninterleaving (seed %d):\n%s", checkErr, s.seed, strings.Join(s.trace, "\n"))
+		}
+	}
+}
+
+// Makes connections running in their own goroutines execute their commands in
+// a fixed order, so that a test can force an interleaving regardless of how
+// the goroutines are scheduled. Each command waits until its connection is
+// the next one in the order, and the order advances once it completes.
+type stepGate struct {
+	mu    sync.Mutex
+	turn  *sync.Cond
+	order []*Connection
+}
+
+// Creates a gate letting each listed connection run one command in turn. Once
+// a connection has no more turns, its commands run freely.
+func newStepGate(order ...*Connection) *stepGate {
+	g := &stepGate{order: order}
+	g.turn = sync.NewCond(&g.mu)
+	return g
+}
+
+// Blocks until it is the connection's turn and returns the function ending
+// it.
+func (g *stepGate) wait(c *Connection) func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for len(g.order) > 0 && g.order[0] != c && slices.Contains(g.order, c) {
+		g.turn.Wait()
+	}
+
+	if len(g.order) == 0 || g.order[0] != c {
+		return func() {}
+	}
+
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		g.order = g.order[1:]
+		g.turn.Broadcast()
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+type ExportMode uint8
+
+const (
+	// A logical snapshot holds only the latest committed value of each key.
+	// Importing it yields a single committed transaction that wrote them all.
+	ExportLogical ExportMode = iota
+	// A physical snapshot holds the whole version chain of each key along
+	// with the states of the transactions that created and deleted them.
+	// Transactions still in progress are exported as aborted.
+	ExportPhysical
+)
+
+type snapshotJSON struct {
+	Mode string `json:"mode"`
+
+	// Logical snapshots only.
+	Values map[string]string `json:"values,omitempty"`
+
+	// Physical snapshots only.
+	NextTransactionId uint64                   `json:"next_transaction_id,omitempty"`
+	Transactions      []transactionJSON        `json:"transactions,omitempty"`
+	Versions          map[string][]versionJSON `json:"versions,omitempty"`
+}
+
+type transactionJSON struct {
+	Id        uint64 `json:"id"`
+	Committed bool   `json:"committed"`
+}
+
+type versionJSON struct {
+	Start     uint64    `json:"start"`
+	End       uint64    `json:"end"`
+	Value     string    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// Writes the contents of the database to w as JSON.
+func (d *Database) ExportJSON(w io.Writer, mode ExportMode) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	snapshot := snapshotJSON{}
+
+	if mode == ExportLogical {
+		snapshot.Mode = "logical"
+		snapshot.Values = map[string]string{}
+
+		// A read committed transaction that starts after every other one sees
+		// exactly the latest committed values.
+		t := &Transaction{id: d.nextTransactionId, isolation: IsolationLevelReadCommitted}
+		for key := range d.store {
+			if value, ok := d.get(t, key); ok {
+				snapshot.Values[key] = value.value
+			}
+		}
+	} else {
+		snapshot.Mode = "physical"
+		snapshot.NextTransactionId = d.nextTransactionId
+		snapshot.Versions = map[string][]versionJSON{}
+
+		iter := d.transactions.Iter()
+		for ok := iter.First(); ok; ok = iter.Next() {
+			snapshot.Transactions = append(snapshot.Transactions, transactionJSON{
+				Id:        iter.Key(),
+				Committed: iter.Value().state == TransactionStateCommitted,
+			})
+		}
+
+		for key, chain := range d.store {
+			snapshot.Versions[key] = chainJSON(chain)
+		}
+	}
+
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// Returns the versions of the chain oldest first.
+func chainJSON(chain *versions) []versionJSON {
+	values := []versionJSON{}
+	chain.Scan(func(_ uint64, value Value) bool {
+		values = append(values, versionJSON{
+			Start: value.txStartId,
+			End:   value.txEndId,
+			Value: value.value,
+
+			ExpiresAt: value.expiresAt,
+		})
+		return true
+	})
+	return values
+}
+
+// Returns the whole version chain of the key as a JSON array, regardless of
+// visibility.
+func (d *Database) dumpKey(key string) (string, error) {
+	values := []versionJSON{}
+	if chain, ok := d.store[key]; ok {
+		values = chainJSON(chain)
+	}
+
+	b, err := json.Marshal(values)
+	return string(b), err
+}
+
+// Replaces the contents of the database with a snapshot written by
+// ExportJSON. The database must not have transactions in progress, and is left
+// as it was if the snapshot is invalid. Commit times aren't exported, so
+// getastime reads the imported state as of the import and fails with
+// ErrHistoryUnavailable before it.
+func (d *Database) ImportJSON(r io.Reader) error {
+	snapshot := snapshotJSON{}
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	if err := snapshot.validate(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if inprogress := d.inprogress(); inprogress.Len() > 0 {
+		return fmt.Errorf("cannot import with %w", ErrActiveTransactions)
+	}
+
+	clear(d.store)
+	clear(d.accessed)
+	clear(d.expiredVersions)
+	d.forgetTransactions()
+
+	if snapshot.Mode == "logical" {
+		d.importLogical(snapshot)
+	} else {
+		d.importPhysical(snapshot)
+	}
+
+	d.prunedCommitId = d.nextCommitId - 1
+	d.prunedCommitTime = d.now()
+	return nil
+}
+
+// Checks that every transaction id of a physical snapshot was handed out
+// before it was taken, which visibility relies on.
+func (s *snapshotJSON) validate() error {
+	switch s.Mode {
+	case "logical":
+		return nil
+	case "physical":
+	default:
+		return fmt.Errorf("%w: unknown mode %q", ErrInvalidSnapshot, s.Mode)
+	}
+
+	valid := func(id uint64) bool {
+		return id > 0 && id < s.NextTransactionId
+	}
+
+	for _, tx := range s.Transactions {
+		if !valid(tx.Id) {
+			return fmt.Errorf("%w: transaction %d not below the next id", ErrInvalidSnapshot, tx.Id)
+		}
+	}
+
+	for key, values := range s.Versions {
+		for _, value := range values {
+			if !valid(value.Start) || (value.End > 0 && !valid(value.End)) {
+				return fmt.Errorf("%w: version of %q by a transaction not below the next id", ErrInvalidSnapshot, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *Database) importLogical(snapshot snapshotJSON) {
+	t := &Transaction{id: 1, isolation: IsolationLevelReadCommitted, state: TransactionStateInProgress}
+	d.transactions.Set(t.id, t)
+	d.nextTransactionId = 2
+
+	for key, value := range snapshot.Values {
+		d.set(t, key, value)
+	}
+
+	t.undo = nil
+	t.state = TransactionStateCommitted
+	t.commitId = 1
+	d.nextCommitId = 2
+}
+
+func (d *Database) importPhysical(snapshot snapshotJSON) {
+	// Commit order isn't exported, and every imported transaction is finished,
+	// so ids stand in for commit ids.
+	d.nextTransactionId = snapshot.NextTransactionId
+	d.nextCommitId = snapshot.NextTransactionId
+	for _, tx := range snapshot.Transactions {
+		t := &Transaction{id: tx.Id, state: TransactionStateAborted}
+		if tx.Committed {
+			t.state = TransactionStateCommitted
+			t.commitId = tx.Id
+		}
+		d.transactions.Set(t.id, t)
+	}
+
+	// Aborting a transaction rolls back its writes, but the transactions in
+	// progress during the export are imported as aborted with their writes
+	// still in place. Those are undone here so that no chain holds versions
+	// that will never be visible.
+	aborted := func(id uint64) bool {
+		t, ok := d.transactions.Get(id)
+		return ok && t.state == TransactionStateAborted
+	}
+
+	for key, values := range snapshot.Versions {
+		for _, value := range values {
+			if aborted(value.Start) {
+				continue
+			}
+
+			end := value.End
+			if aborted(end) {
+				end = 0
+			}
+
+			d.chain(key).Set(value.Start, Value{
+				txStartId: value.Start,
+				txEndId:   end,
+				value:     value.Value,
+				expiresAt: value.ExpiresAt,
+			})
+		}
+	}
+}
+
+// A read-only view of the database pinned to the point in time it was taken,
+// for reading a consistent state, such as for backups, while writes go on.
+// It is backed by a read-only repeatable read transaction, so vacuum keeps the
+// versions it can see until it is released, and like any transaction it is
+// aborted by ReapExpired once older than TxTimeout.
+type Snapshot struct {
+	db *Database
+	tx *Transaction
+}
+
+// Pins the current state of the database until the snapshot is released.
+func (d *Database) Snapshot() (*Snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, err := d.newTransaction(IsolationLevelRepeatableRead, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{db: d, tx: t}, nil
+}
+
+// Returns the value of the key as of when the snapshot was taken, or
+// ErrNoSuchKey if it had none.
+func (s *Snapshot) Get(key string) (string, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if s.tx.abortReason != nil {
+		return "", s.tx.abortReason
+	}
+
+	if s.tx.state != TransactionStateInProgress {
+		return "", ErrTransactionFinished
+	}
+
+	if value, ok := s.db.get(s.tx, key); ok {
+		return value.value, nil
+	}
+	return "", ErrNoSuchKey
+}
+
+// Unpins the snapshot, letting vacuum reclaim the versions only it could see.
+func (s *Snapshot) Release() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if s.tx.state == TransactionStateInProgress {
+		s.db.completeTransaction(s.tx, TransactionStateCommitted)
+	}
+}
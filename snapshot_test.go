@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExportImportJSON(t *testing.T) {
+	db := newDatabase()
+
+	c1 := db.newConnection()
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "1"})
+	c1.mustExecCommand("set", []string{"y", "1"})
+	c1.mustExecCommand("set", []string{"z", "1"})
+	c1.mustExecCommand("commit", nil)
+
+	c1.mustExecCommand("begin", nil)
+	c1.mustExecCommand("set", []string{"x", "2"})
+	c1.mustExecCommand("delete", []string{"y"})
+	c1.mustExecCommand("commit", nil)
+
+	// Uncommitted writes are not part of the snapshot.
+	c2 := db.newConnection()
+	c2.mustExecCommand("begin", nil)
+	c2.mustExecCommand("set", []string{"z", "2"})
+
+	for _, mode := range []ExportMode{ExportLogical, ExportPhysical} {
+		buf := bytes.Buffer{}
+		assertEq(db.ExportJSON(&buf, mode), nil, "export")
+
+		imported := newDatabase()
+		assertEq(imported.ImportJSON(&buf), nil, "import")
+
+		c := imported.newConnection()
+		c.mustExecCommand("begin", nil)
+
+		res := c.mustExecCommand("get", []string{"x"})
+		assertEq(res, "2", "get x")
+
+		_, err := c.execCommand("get", []string{"y"})
+		assert(errors.Is(err, ErrNoSuchKey), "get y")
+
+		res = c.mustExecCommand("get", []string{"z"})
+		assertEq(res, "1", "get z")
+
+		res = c.mustExecCommand("get", []string{"y", "status"})
+		if mode == ExportPhysical {
+			// The whole history is kept.
+			assertEq(res, "deleted", "get y status")
+		} else {
+			assertEq(res, "never-existed", "get y status")
+		}
+
+		// Importing over active transactions is refused.
+		err = imported.ImportJSON(bytes.NewBufferString(`{"mode": "logical"}`))
+		assert(errors.Is(err, ErrActiveTransactions), "import with active transactions")
+	}
+}
+
+func TestImportInvalidSnapshot(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+
+	for _, snapshot := range []string{
+		`{}`,
+		`{"mode": "incremental"}`,
+		`{"mode": "physical", "next_transaction_id": 2, "transactions": [{"id": 5, "committed": true}]}`,
+		`{"mode": "physical", "next_transaction_id": 2, "versions": {"y": [{"start": 1, "end": 3, "value": "1"}]}}`,
+	} {
+		err := db.ImportJSON(bytes.NewBufferString(snapshot))
+		assert(errors.Is(err, ErrInvalidSnapshot), "import "+snapshot)
+
+		// The database is left as it was.
+		c.mustExecCommand("begin", nil)
+		assertEq(c.mustExecCommand("get", []string{"x"}), "1", "get x after "+snapshot)
+		c.mustExecCommand("commit", nil)
+	}
+}
+
+func TestImportGetAsTime(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+
+	for _, mode := range []ExportMode{ExportLogical, ExportPhysical} {
+		buf := bytes.Buffer{}
+		assertEq(db.ExportJSON(&buf, mode), nil, "export")
+
+		imported := newDatabase()
+		now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		imported.now = func() time.Time { return now }
+		assertEq(imported.ImportJSON(&buf), nil, "import")
+
+		// Commit times aren't exported, so history starts at the import.
+		c := imported.newConnection()
+		assertEq(c.mustExecCommand("getastime", []string{"2024-01-01T12:00:00Z", "x"}), "1", "x at the import")
+		_, err := c.execCommand("getastime", []string{"2024-01-01T11:00:00Z", "x"})
+		assert(errors.Is(err, ErrHistoryUnavailable), "x before the import")
+	}
+}
+
+func TestAbortedWritesLeaveNoVersions(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	for i := 0; i < 100; i++ {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand("set", []string{"x", "aborted"})
+		c.mustExecCommand("abort", nil)
+	}
+	assertEq(chainLength(db, "x"), 0, "x versions")
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"y", "committed"})
+	c.mustExecCommand("commit", nil)
+
+	// Exported while in progress, so imported as aborted.
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "in progress"})
+	c.mustExecCommand("set", []string{"y", "in progress"})
+
+	buf := bytes.Buffer{}
+	assertEq(db.ExportJSON(&buf, ExportPhysical), nil, "export")
+	imported := newDatabase()
+	assertEq(imported.ImportJSON(&buf), nil, "import")
+	assertEq(chainLength(imported, "x"), 0, "x versions")
+	assertEq(chainLength(imported, "y"), 1, "y versions")
+
+	c = imported.newConnection()
+	c.mustExecCommand("begin", []string{"read_uncommitted"})
+	_, err := c.execCommand("get", []string{"x"})
+	assert(errors.Is(err, ErrNoSuchKey), "get x")
+	assertEq(c.mustExecCommand("get", []string{"y"}), "committed", "get y")
+}
+
+func TestDumpKey(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	for _, command := range [][]string{{"set", "x", "a"}, {"set", "x", "b"}, {"delete", "x"}} {
+		c.mustExecCommand("begin", nil)
+		c.mustExecCommand(command[0], command[1:])
+		c.mustExecCommand("commit", nil)
+	}
+
+	c.mustExecCommand("begin", nil)
+	res := c.mustExecCommand("dumpkey", []string{"x"})
+	assertEq(res, `[{"start":1,"end":2,"value":"a"},{"start":2,"end":3,"value":"b"}]`, "dumpkey x")
+	assertEq(c.tx.readset.Len(), 0, "readset size")
+
+	res = c.mustExecCommand("dumpkey", []string{"y"})
+	assertEq(res, "[]", "dumpkey y")
+}
+
+func TestPinnedSnapshot(t *testing.T) {
+	db := newDatabase()
+	c := db.newConnection()
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "1"})
+	c.mustExecCommand("commit", nil)
+
+	s, err := db.Snapshot()
+	assertEq(err, nil, "snapshot")
+
+	c.mustExecCommand("begin", nil)
+	c.mustExecCommand("set", []string{"x", "2"})
+	c.mustExecCommand("set", []string{"y", "2"})
+	c.mustExecCommand("commit", nil)
+
+	assertEq(db.Vacuum(), 0, "versions removed while pinned")
+
+	value, err := s.Get("x")
+	assertEq(err, nil, "snapshot get x")
+	assertEq(value, "1", "snapshot x")
+	_, err = s.Get("y")
+	assert(errors.Is(err, ErrNoSuchKey), "snapshot get y")
+
+	c.mustExecCommand("begin", nil)
+	assertEq(c.mustExecCommand("get", []string{"x"}), "2", "fresh transaction x")
+	c.mustExecCommand("commit", nil)
+
+	s.Release()
+	assertEq(db.Vacuum(), 1, "versions removed once released")
+	_, err = s.Get("x")
+	assert(errors.Is(err, ErrTransactionFinished), "get after release")
+}